@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/accrualsim"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const shutdownTimeout = 5 * time.Second
+
+func main() {
+	cfg := accrualsim.Config{}
+	serverAddress := ""
+	rules := ""
+
+	flag.StringVar(&serverAddress, "a", os.Getenv("RUN_ADDRESS"), "")
+	flag.DurationVar(&cfg.Latency, "latency", 0, "")
+	flag.DurationVar(&cfg.LatencyJitter, "latency-jitter", 0, "")
+	flag.DurationVar(&cfg.ProcessingAfter, "processing-after", time.Second, "")
+	flag.DurationVar(&cfg.ProcessedAfter, "processed-after", 3*time.Second, "")
+	flag.BoolVar(&cfg.AutoRegister, "auto-register", false, "")
+	flag.Float64Var(&cfg.InvalidRate, "invalid-rate", 0.1, "")
+	flag.StringVar(&rules, "rules", "*:5%", "")
+	flag.IntVar(&cfg.RateLimit, "rate-limit", 0, "")
+	flag.Float64Var(&cfg.ErrorRate, "error-rate", 0, "")
+	flag.Float64Var(&cfg.SlowRate, "slow-rate", 0, "")
+	flag.DurationVar(&cfg.SlowDelay, "slow-delay", 5*time.Second, "")
+	flag.Int64Var(&cfg.Seed, "seed", time.Now().UnixNano(), "")
+
+	flag.Parse()
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		fmt.Printf("failed to initialize logger: %+v", err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+
+	if len(serverAddress) == 0 {
+		serverAddress = ":8081"
+	}
+
+	cfg.Rules, err = accrualsim.ParseRules(rules)
+	if err != nil {
+		logger.Fatal("Failed to parse reward rules", zap.Error(err))
+	}
+	cfg.Logger = logger
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer cancel()
+
+	server := &http.Server{Addr: serverAddress, Handler: accrualsim.New(cfg).Handler()}
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Failed to shutdown server gracefully", zap.Error(err))
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Fatal("Failed to serve", zap.Error(err))
+	}
+}
@@ -2,72 +2,223 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/r4start/go-musthave-diploma-tpl/internal/accrual"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/config"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/events"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/lifecycle"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/metrics"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/ratelimit"
 	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/tracing"
 	"go.uber.org/zap"
 	"os"
 
 	"github.com/r4start/go-musthave-diploma-tpl/internal/app"
 )
 
-type config struct {
-	ServerAddress            string
-	AccrualSystemAddress     string
-	DatabaseConnectionString string
-}
-
-func main() {
-	cfg := config{
-		ServerAddress: ":8080",
+func run() int {
+	cfg, opts, err := config.Load(os.Args[0], os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
 	}
 
-	flag.StringVar(&cfg.ServerAddress, "a", os.Getenv("RUN_ADDRESS"), "")
-	flag.StringVar(&cfg.AccrualSystemAddress, "r", os.Getenv("ACCRUAL_SYSTEM_ADDRESS"), "")
-	flag.StringVar(&cfg.DatabaseConnectionString, "d", os.Getenv("DATABASE_URI"), "")
-
-	flag.Parse()
-
-	logger, err := zap.NewProduction()
+	// The configuration is printed even if it is invalid,
+	// the problems are listed after it.
+	if opts.PrintConfig && cfg != nil {
+		if err := cfg.Print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
 	if err != nil {
-		fmt.Printf("failed to initialize logger: %+v", err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-	defer logger.Sync()
-
-	if len(cfg.DatabaseConnectionString) == 0 {
-		logger.Fatal("Empty database connection string")
+	if opts.PrintConfig {
+		return 0
 	}
 
-	dbConn, err := pgxpool.Connect(context.Background(), cfg.DatabaseConnectionString)
+	// The level is atomic to be changed on reload.
+	level, _ := cfg.Log.ZapLevel()
+	logLevel := zap.NewAtomicLevelAt(level)
+	loggerConfig := zap.NewProductionConfig()
+	loggerConfig.Level = logLevel
+	logger, err := loggerConfig.Build()
 	if err != nil {
-		logger.Fatal("Failed to connect to database", zap.Error(err))
+		fmt.Printf("failed to initialize logger: %+v", err)
+		return 1
 	}
-	defer dbConn.Close()
+	defer logger.Sync()
 
 	storageCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	st, err := storage.NewDatabaseStorage(storageCtx, dbConn)
-	if err != nil {
-		logger.Fatal("Failed to initialize storage", zap.Error(err))
-	}
+	bus := events.NewBus(events.Config{
+		HistorySize:             cfg.Events.HistorySize,
+		MaxSubscriptionsPerUser: cfg.Events.MaxSubscriptionsPerUser,
+	})
+	m := metrics.New()
 
-	serverCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	var (
+		dbConn  *pgxpool.Pool
+		st      storage.AppStorage
+		updater *accrual.Updater
+		server  *app.Server
+	)
 
-	updaterCtx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	lc := lifecycle.New(logger, lifecycle.Config{
+		StartTimeout: cfg.Lifecycle.StartTimeout.Duration(),
+		StopTimeout:  cfg.Lifecycle.StopTimeout.Duration(),
+	})
+
+	// Tracing is stopped last to flush the spans of the other components.
+	var shutdownTracing func(ctx context.Context) error
+	lc.Append(lifecycle.Hook{
+		Name: "tracing",
+		OnStart: func(ctx context.Context) error {
+			var err error
+			shutdownTracing, err = tracing.Setup(ctx, tracing.Config{
+				Exporter:     cfg.Tracing.Exporter,
+				OTLPEndpoint: cfg.Tracing.OTLPEndpoint,
+				OTLPInsecure: cfg.Tracing.OTLPInsecure,
+				ServiceName:  cfg.Tracing.ServiceName,
+			})
+			return err
+		},
+		OnStop: func(ctx context.Context) error {
+			return shutdownTracing(ctx)
+		},
+	})
+
+	lc.Append(lifecycle.Hook{
+		Name: "database",
+		OnStart: func(ctx context.Context) error {
+			var err error
+			if dbConn, err = pgxpool.Connect(ctx, cfg.Database.URI); err != nil {
+				return err
+			}
+			if st, err = storage.NewDatabaseStorage(storageCtx, dbConn, storage.Config{
+				OperationTimeout: cfg.Database.OperationTimeout.Duration(),
+				ExportTimeout:    cfg.Database.ExportTimeout.Duration(),
+			}); err != nil {
+				dbConn.Close()
+				return err
+			}
+			if err := m.RegisterPool(dbConn); err != nil {
+				dbConn.Close()
+				return err
+			}
+			st = metrics.InstrumentStorage(st, m)
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			dbConn.Close()
+			return nil
+		},
+	})
+
+	lc.Append(lifecycle.Hook{
+		Name: "accrual updater",
+		OnStart: func(ctx context.Context) error {
+			updater = accrual.NewUpdater(context.Background(), accrual.Config{
+				BaseAddr:       cfg.Accrual.Address,
+				PollInterval:   cfg.Accrual.PollInterval.Duration(),
+				RetryCount:     cfg.Accrual.RetryCount,
+				CallbackSecret: []byte(cfg.Accrual.CallbackSecret),
+				Schedule:       cfg.Accrual.Schedule.Policy(),
+				Breaker:        cfg.Accrual.Breaker.Config(),
+				RateLimit:      cfg.Accrual.RateLimit,
+				RateBurst:      cfg.Accrual.RateBurst,
+				Events:         bus,
+				Metrics:        m,
+				Logger:         logger,
+				AppStorage:     st,
+
+				CallbackReplayWindow: cfg.Accrual.CallbackReplayWindow.Duration(),
+				StuckCheckInterval:   cfg.Accrual.StuckCheckInterval.Duration(),
+			})
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			unprocessed, err := updater.Stop(ctx)
+			if err != nil {
+				logger.Error("Accrual updater wasn't drained in time", zap.Int("unprocessed_orders", unprocessed))
+				return err
+			}
+			logger.Info("Accrual updater drained", zap.Int("unprocessed_orders", unprocessed))
+			return nil
+		},
+		StopTimeout: cfg.Accrual.DrainTimeout.Duration(),
+	})
+
+	lc.Append(lifecycle.Hook{
+		Name: "server",
+		OnStart: func(ctx context.Context) error {
+			var limits ratelimit.Store
+			if cfg.Server.RateLimit.Enabled {
+				switch cfg.Server.RateLimit.Store {
+				case config.RateLimitStoreMemory:
+					limits = ratelimit.NewMemoryStore()
+				case config.RateLimitStorePostgres:
+					limits = ratelimit.NewPostgresStore(dbConn, cfg.Database.OperationTimeout.Duration())
+				}
+			}
 
-	accCfg := accrual.Config{
-		BaseAddr:   cfg.AccrualSystemAddress,
-		Logger:     logger,
-		AppStorage: st,
+			var err error
+			server, err = app.NewServer(context.Background(), app.ServerConfig{
+				Address:          cfg.Server.Address,
+				InternalAddress:  cfg.Server.InternalAddress,
+				AdminToken:       cfg.Server.AdminToken,
+				ValidateRequests: cfg.Server.ValidateRequests,
+				RequestTimeout:   cfg.Server.RequestTimeout.Duration(),
+				CompressionLevel: cfg.Server.CompressionLevel,
+				ReadinessTimeout: cfg.Server.ReadinessTimeout.Duration(),
+				TLS:              cfg.Server.TLS.Server(),
+				RateLimit:        cfg.Server.RateLimit.Server(limits),
+				CORSOrigins:      cfg.Server.CORSOrigins,
+				LoginLockout:     cfg.Server.LoginLockout.Policy(),
+
+				StreamHeartbeatInterval: cfg.Server.StreamHeartbeatInterval.Duration(),
+				GRPCAddress:             cfg.Server.GRPCAddress,
+			}, logger, st, updater, bus, m)
+			if err != nil {
+				return err
+			}
+			return server.Start(lc.Fail)
+		},
+		OnStop: func(ctx context.Context) error {
+			return server.Stop(ctx)
+		},
+		StopTimeout: cfg.Server.ShutdownTimeout.Duration(),
+	})
+
+	reloader := &configReloader{
+		snapshot: config.NewSnapshot(cfg),
+		logger:   logger,
+		apply: func(cfg *config.Config) {
+			level, _ := cfg.Log.ZapLevel()
+			logLevel.SetLevel(level)
+			updater.SetTuning(cfg.Accrual.Tuning())
+			server.SetTuning(cfg.Server.Tuning())
+		},
+	}
+	lc.Append(lifecycle.Hook{
+		Name:    "config reload",
+		OnStart: reloader.Start,
+		OnStop:  reloader.Stop,
+	})
+
+	if err := lc.Run(context.Background()); err != nil {
+		logger.Error("Service failed", zap.Error(err))
+		return 1
 	}
-	updater := accrual.NewUpdater(updaterCtx, accCfg)
-	defer updater.Stop()
+	return 0
+}
 
-	app.RunServerApp(serverCtx, cfg.ServerAddress, logger, st)
+func main() {
+	os.Exit(run())
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/config"
+	"go.uber.org/zap"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// configReloader reloads the configuration on SIGHUP.
+// Only the reloadable settings are applied, see config.Snapshot.
+type configReloader struct {
+	snapshot *config.Snapshot
+	logger   *zap.Logger
+	apply    func(cfg *config.Config)
+
+	signals chan os.Signal
+	done    chan struct{}
+}
+
+func (r *configReloader) Start(ctx context.Context) error {
+	r.signals = make(chan os.Signal, 1)
+	r.done = make(chan struct{})
+	signal.Notify(r.signals, syscall.SIGHUP)
+
+	go func() {
+		defer close(r.done)
+		for range r.signals {
+			r.reload()
+		}
+	}()
+	return nil
+}
+
+func (r *configReloader) Stop(ctx context.Context) error {
+	signal.Stop(r.signals)
+	close(r.signals)
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *configReloader) reload() {
+	applied, ignored, err := r.snapshot.Reload(os.Args[0], os.Args[1:], os.Getenv)
+	if err != nil {
+		r.logger.Error("Configuration wasn't reloaded", zap.Error(err))
+		return
+	}
+
+	for _, c := range applied {
+		r.logger.Info("Setting changed", zap.String("setting", c.Path), zap.String("old", c.Old), zap.String("new", c.New))
+	}
+	for _, c := range ignored {
+		r.logger.Warn("Setting change requires a restart", zap.String("setting", c.Path), zap.String("old", c.Old), zap.String("new", c.New))
+	}
+
+	if len(applied) != 0 {
+		r.apply(r.snapshot.Load())
+	}
+	r.logger.Info("Configuration reloaded", zap.Int("applied", len(applied)), zap.Int("ignored", len(ignored)))
+}
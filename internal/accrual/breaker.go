@@ -0,0 +1,211 @@
+package accrual
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+var (
+	ErrCircuitOpen      = errors.New("accrual system circuit is open")
+	ErrBadBreakerConfig = errors.New("bad accrual circuit breaker config")
+)
+
+// BreakerConfig configures the circuit breaker around the accrual system.
+// The circuit opens after FailureThreshold consecutive failures, stays open
+// for OpenTimeout and then lets up to HalfOpenRequests probe requests through.
+// A successful probe closes the circuit, a failed one opens it again.
+type BreakerConfig struct {
+	FailureThreshold int
+	OpenTimeout      time.Duration
+	HalfOpenRequests int
+}
+
+func DefaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		FailureThreshold: 5,
+		OpenTimeout:      30 * time.Second,
+		HalfOpenRequests: 1,
+	}
+}
+
+func (c BreakerConfig) Validate() error {
+	if c.FailureThreshold <= 0 || c.OpenTimeout <= 0 || c.HalfOpenRequests <= 0 {
+		return ErrBadBreakerConfig
+	}
+	return nil
+}
+
+type BreakerSnapshot struct {
+	State     string    `json:"state"`
+	Failures  int       `json:"consecutive_failures"`
+	Rejected  int       `json:"rejected_requests"`
+	ChangedAt time.Time `json:"changed_at"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	cfg       BreakerConfig
+	logger    *zap.Logger
+	state     BreakerState
+	failures  int
+	probes    int
+	rejected  int
+	changedAt time.Time
+	lastErr   error
+}
+
+func NewCircuitBreaker(cfg BreakerConfig, logger *zap.Logger) *CircuitBreaker {
+	return &CircuitBreaker{
+		cfg:       cfg,
+		logger:    logger,
+		state:     BreakerClosed,
+		changedAt: time.Now(),
+	}
+}
+
+// SetConfig replaces the thresholds, the current state is kept.
+func (b *CircuitBreaker) SetConfig(cfg BreakerConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cfg = cfg
+}
+
+// Allow reports whether a request to the accrual system may be made.
+// Every allowed request must be followed by Success, Failure or Release.
+func (b *CircuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && time.Since(b.changedAt) >= b.cfg.OpenTimeout {
+		b.setState(BreakerHalfOpen)
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		b.rejected++
+		return false
+	case BreakerHalfOpen:
+		if b.probes >= b.cfg.HalfOpenRequests {
+			b.rejected++
+			return false
+		}
+		b.probes++
+	}
+
+	return true
+}
+
+// Ready reports whether the circuit lets requests through without
+// registering an attempt. It is used to skip whole polling cycles.
+func (b *CircuitBreaker) Ready() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state != BreakerOpen || time.Since(b.changedAt) >= b.cfg.OpenTimeout
+}
+
+func (b *CircuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.state != BreakerClosed {
+		b.setState(BreakerClosed)
+	}
+}
+
+// Release gives back an allowed request which was cancelled before
+// the accrual system answered, its outcome is not recorded.
+func (b *CircuitBreaker) Release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (b *CircuitBreaker) Failure(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.lastErr = err
+
+	switch b.state {
+	case BreakerClosed:
+		if b.failures >= b.cfg.FailureThreshold {
+			b.setState(BreakerOpen)
+		}
+	case BreakerHalfOpen:
+		b.setState(BreakerOpen)
+	}
+}
+
+func (b *CircuitBreaker) Snapshot() BreakerSnapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s := BreakerSnapshot{
+		State:     b.state.String(),
+		Failures:  b.failures,
+		Rejected:  b.rejected,
+		ChangedAt: b.changedAt,
+	}
+	if b.lastErr != nil {
+		s.LastError = b.lastErr.Error()
+	}
+	return s
+}
+
+// setState must be called with b.mu held.
+func (b *CircuitBreaker) setState(state BreakerState) {
+	fields := []zap.Field{
+		zap.String("from", b.state.String()),
+		zap.String("to", state.String()),
+		zap.Duration("in_previous_state", time.Since(b.changedAt)),
+		zap.Int("consecutive_failures", b.failures),
+		zap.Int("rejected_requests", b.rejected),
+	}
+	if b.lastErr != nil {
+		fields = append(fields, zap.NamedError("last_error", b.lastErr))
+	}
+
+	if state == BreakerOpen {
+		b.logger.Error("accrual circuit breaker state changed", fields...)
+	} else {
+		b.logger.Info("accrual circuit breaker state changed", fields...)
+	}
+
+	b.state = state
+	b.changedAt = time.Now()
+	b.probes = 0
+	if state == BreakerClosed {
+		b.rejected = 0
+		b.lastErr = nil
+	}
+}
@@ -0,0 +1,175 @@
+package accrual
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/logging"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CallbackTimestampHeader = "X-Accrual-Timestamp"
+	CallbackSignatureHeader = "X-Accrual-Signature"
+
+	callbackSignaturePrefix = "sha256="
+	callbackMaxBodySize     = 64 * 1024
+)
+
+var (
+	ErrCallbackDisabled     = errors.New("accrual callback secret is not configured")
+	ErrBadCallbackTimestamp = errors.New("callback timestamp is missing or out of replay window")
+	ErrBadCallbackSignature = errors.New("callback signature mismatch")
+	ErrCallbackReplay       = errors.New("callback was already processed")
+)
+
+// SignCallback returns the value of CallbackSignatureHeader for the body
+// sent at the given unix timestamp.
+func SignCallback(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return callbackSignaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (u *Updater) CallbackEnabled() bool {
+	return len(u.CallbackSecret) != 0
+}
+
+// HandleCallback accepts a pushed order status update from the accrual system.
+// The request body has the same format as the GET /api/orders/{number} response.
+func (u *Updater) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), u.Logger)
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, callbackMaxBodySize))
+	if err != nil {
+		logger.Error("failed to read callback body", zap.Error(err))
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if err := u.verifyCallback(r, body); err != nil {
+		logger.Error("callback verification failed", zap.Error(err))
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+
+	var info orderInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		logger.Error("failed to unmarshal callback body", zap.Error(err))
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	orderID, err := strconv.ParseInt(info.Order, 10, 64)
+	if err != nil {
+		logger.Error("bad order id in callback", zap.String("order_id", info.Order))
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	order, err := u.GetOrder(r.Context(), orderID)
+	if err != nil {
+		if errors.Is(err, storage.ErrNoSuchOrder) {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		logger.Error("failed to get order", zap.Int64("order_id", orderID), zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if order.Status == storage.StatusProcessed || order.Status == storage.StatusInvalid {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	previousStatus := order.Status
+	credit := applyOrderInfo(order, &info)
+	if credit {
+		_, err = u.UpdateBalanceFromOrders(r.Context(), []storage.Order{*order})
+	} else {
+		err = u.UpdateOrder(r.Context(), *order)
+	}
+	if err != nil {
+		logger.Error("failed to apply callback", zap.Int64("order_id", orderID), zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	if order.Status != previousStatus {
+		u.publishOrderStatus(*order)
+	}
+	if credit {
+		u.publishBalance(r.Context(), order.UserID)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (u *Updater) verifyCallback(r *http.Request, body []byte) error {
+	if len(u.CallbackSecret) == 0 {
+		return ErrCallbackDisabled
+	}
+
+	timestamp, err := strconv.ParseInt(r.Header.Get(CallbackTimestampHeader), 10, 64)
+	if err != nil {
+		return ErrBadCallbackTimestamp
+	}
+
+	sentAt := time.Unix(timestamp, 0)
+	if age := time.Since(sentAt); age > u.CallbackReplayWindow || age < -u.CallbackReplayWindow {
+		return ErrBadCallbackTimestamp
+	}
+
+	signature := strings.TrimSpace(r.Header.Get(CallbackSignatureHeader))
+	expected := SignCallback(u.CallbackSecret, timestamp, body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return ErrBadCallbackSignature
+	}
+
+	if !u.callbacks.add(signature, sentAt.Add(u.CallbackReplayWindow)) {
+		return ErrCallbackReplay
+	}
+
+	return nil
+}
+
+// signatureCache remembers signatures of accepted callbacks until
+// they fall out of the replay window.
+type signatureCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func newSignatureCache() *signatureCache {
+	return &signatureCache{entries: make(map[string]time.Time)}
+}
+
+func (c *signatureCache) add(signature string, expiresAt time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for s, e := range c.entries {
+		if now.After(e) {
+			delete(c.entries, s)
+		}
+	}
+
+	if _, exists := c.entries[signature]; exists {
+		return false
+	}
+	c.entries[signature] = expiresAt
+	return true
+}
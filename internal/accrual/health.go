@@ -0,0 +1,83 @@
+package accrual
+
+import (
+	"encoding/json"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/logging"
+	"go.uber.org/zap"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// The updater is stale if it has made no progress for staleCycles poll
+// intervals plus staleCycleTime, which is given to a single poll.
+const (
+	staleCycles    = 3
+	staleCycleTime = time.Minute
+)
+
+// UpdaterHealth describes whether the updater keeps polling orders.
+type UpdaterHealth struct {
+	LastCycle    *time.Time      `json:"last_successful_cycle,omitempty"`
+	LastProgress *time.Time      `json:"last_progress,omitempty"`
+	Stale        bool            `json:"stale"`
+	Breaker      BreakerSnapshot `json:"breaker"`
+}
+
+type healthResponse struct {
+	Breaker BreakerSnapshot `json:"breaker"`
+}
+
+// HandleHealth reports the state of the accrual system circuit breaker.
+// It responds with 503 while the circuit is open.
+func (u *Updater) HandleHealth(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), u.Logger)
+
+	resp := healthResponse{Breaker: u.BreakerState()}
+
+	dst, err := json.Marshal(resp)
+	if err != nil {
+		logger.Error("failed to marshal health response", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	statusCode := http.StatusOK
+	if resp.Breaker.State == BreakerOpen.String() {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	if _, err := w.Write(dst); err != nil {
+		logger.Error("failed to write response body", zap.Error(err))
+	}
+}
+
+// Health reports the last successful polling cycle and the circuit state.
+// The updater is stale if neither a cycle nor a poll has completed lately.
+// Cycles are skipped while the circuit is open, so it isn't stale then.
+func (u *Updater) Health() UpdaterHealth {
+	health := UpdaterHealth{Breaker: u.BreakerState()}
+
+	since := time.Unix(0, atomic.LoadInt64(&u.startedAt))
+	if lastCycle := atomic.LoadInt64(&u.lastCycle); lastCycle != 0 {
+		t := time.Unix(0, lastCycle)
+		health.LastCycle = &t
+		since = t
+	}
+	if lastProgress := atomic.LoadInt64(&u.lastProgress); lastProgress != 0 {
+		t := time.Unix(0, lastProgress)
+		health.LastProgress = &t
+		if t.After(since) {
+			since = t
+		}
+	}
+
+	if health.Breaker.State != BreakerOpen.String() {
+		health.Stale = time.Since(since) > staleCycles*u.Tuning().PollInterval+staleCycleTime
+	}
+
+	return health
+}
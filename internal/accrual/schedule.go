@@ -0,0 +1,91 @@
+package accrual
+
+import (
+	"errors"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"math"
+	"math/rand"
+	"time"
+)
+
+var ErrBadSchedulePolicy = errors.New("bad accrual schedule policy")
+
+// SchedulePolicy describes how often an unfinished order is polled.
+// The first FastAttempts polls are made every InitialInterval, after that
+// the interval grows by Multiplier on every attempt up to MaxInterval.
+// Orders older than MaxAge are flagged as stuck and polled every MaxInterval.
+type SchedulePolicy struct {
+	InitialInterval time.Duration
+	FastAttempts    int
+	Multiplier      float64
+	MaxInterval     time.Duration
+	// Jitter is a fraction of the interval, the actual interval is
+	// randomly chosen from [interval*(1-Jitter), interval*(1+Jitter)].
+	Jitter float64
+	MaxAge time.Duration
+}
+
+func DefaultSchedulePolicy() SchedulePolicy {
+	return SchedulePolicy{
+		InitialInterval: time.Second,
+		FastAttempts:    5,
+		Multiplier:      2,
+		MaxInterval:     10 * time.Minute,
+		Jitter:          0.2,
+		MaxAge:          24 * time.Hour,
+	}
+}
+
+func (p SchedulePolicy) Validate() error {
+	if p.InitialInterval <= 0 || p.MaxInterval < p.InitialInterval {
+		return ErrBadSchedulePolicy
+	}
+	if p.FastAttempts < 0 || p.Multiplier < 1 {
+		return ErrBadSchedulePolicy
+	}
+	if p.Jitter < 0 || p.Jitter >= 1 || p.MaxAge <= 0 {
+		return ErrBadSchedulePolicy
+	}
+	return nil
+}
+
+// Next returns the schedule of the next poll for the order
+// which has just been polled without reaching a final state.
+func (p SchedulePolicy) Next(order storage.Order, now time.Time) storage.OrderSchedule {
+	attempts := order.Attempts + 1
+	stuck := now.Sub(order.UploadedAt) > p.MaxAge
+
+	interval := p.MaxInterval
+	if !stuck {
+		interval = p.interval(attempts)
+	}
+
+	return storage.OrderSchedule{
+		OrderID:       order.ID,
+		NextAttemptAt: now.Add(p.withJitter(interval)),
+		Stuck:         stuck,
+	}
+}
+
+func (p SchedulePolicy) interval(attempts int) time.Duration {
+	if attempts <= p.FastAttempts {
+		return p.InitialInterval
+	}
+
+	factor := math.Pow(p.Multiplier, float64(attempts-p.FastAttempts))
+	interval := float64(p.InitialInterval) * factor
+	if interval >= float64(p.MaxInterval) {
+		return p.MaxInterval
+	}
+
+	return time.Duration(interval)
+}
+
+func (p SchedulePolicy) withJitter(interval time.Duration) time.Duration {
+	if p.Jitter == 0 {
+		return interval
+	}
+
+	delta := float64(interval) * p.Jitter * (2*rand.Float64() - 1)
+	return interval + time.Duration(delta)
+}
@@ -0,0 +1,39 @@
+package accrual
+
+import (
+	"go.uber.org/zap"
+	"time"
+)
+
+// detectStuckOrders periodically flags unfinished orders older than
+// Schedule.MaxAge. Polling flags such orders as well, but it doesn't
+// reach them while the accrual circuit is open or polls are failing.
+func (u *Updater) detectStuckOrders() {
+	defer u.wg.Done()
+
+	ticker := time.NewTicker(u.StuckCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			u.markStuckOrders()
+		case <-u.ctx.Done():
+			return
+		}
+	}
+}
+
+func (u *Updater) markStuckOrders() {
+	orders, err := u.MarkStuckOrders(u.workCtx, u.Tuning().Schedule.MaxAge)
+	if err != nil {
+		u.Logger.Error("failed to mark stuck orders", zap.Error(err))
+		return
+	}
+
+	for _, o := range orders {
+		u.Logger.Warn("order is stuck",
+			zap.Int64("order_id", o.ID),
+			zap.String("status", o.Status),
+			zap.Time("uploaded_at", o.UploadedAt))
+	}
+}
@@ -0,0 +1,72 @@
+package accrual
+
+import (
+	"golang.org/x/time/rate"
+	"time"
+)
+
+const DefaultRateBurst = 1
+
+// Tuning holds the settings which can be changed while the updater runs.
+// Zero values are replaced with the defaults as in Config.
+type Tuning struct {
+	PollInterval time.Duration
+	// RateLimit is the number of requests per second to the accrual
+	// system, zero means no limit.
+	RateLimit float64
+	// RateBurst is the number of requests that may exceed RateLimit at once.
+	RateBurst int
+	Schedule  SchedulePolicy
+	Breaker   BreakerConfig
+}
+
+// Tuning returns the settings currently used by the updater.
+func (u *Updater) Tuning() Tuning {
+	return u.tuning.Load().(Tuning)
+}
+
+// SetTuning replaces the settings, polling cycles already in progress
+// finish with the previous schedule.
+func (u *Updater) SetTuning(t Tuning) {
+	t = t.withDefaults(u.CallbackEnabled())
+
+	u.tuning.Store(t)
+	u.breaker.SetConfig(t.Breaker)
+	u.limiter.SetBurst(t.RateBurst)
+	u.limiter.SetLimit(rateLimit(t.RateLimit))
+
+	// The polling loop picks up the new interval, a pending
+	// notification already makes it do so.
+	select {
+	case u.retuned <- struct{}{}:
+	default:
+	}
+}
+
+func (t Tuning) withDefaults(callbacks bool) Tuning {
+	if t.PollInterval <= 0 {
+		t.PollInterval = DefaultPollInterval
+		if callbacks {
+			// Status updates are pushed by the accrual system,
+			// polling is only a safety net for lost callbacks.
+			t.PollInterval = DefaultCallbackPollInterval
+		}
+	}
+	if t.RateBurst <= 0 {
+		t.RateBurst = DefaultRateBurst
+	}
+	if t.Schedule == (SchedulePolicy{}) {
+		t.Schedule = DefaultSchedulePolicy()
+	}
+	if t.Breaker == (BreakerConfig{}) {
+		t.Breaker = DefaultBreakerConfig()
+	}
+	return t
+}
+
+func rateLimit(perSecond float64) rate.Limit {
+	if perSecond <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(perSecond)
+}
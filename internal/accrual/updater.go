@@ -3,13 +3,25 @@ package accrual
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-resty/resty/v2"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/events"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/metrics"
 	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"golang.org/x/time/rate"
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,21 +38,110 @@ type orderInfo struct {
 	Accrual float64 `json:"accrual"`
 }
 
+const (
+	tracerName = "github.com/r4start/go-musthave-diploma-tpl/internal/accrual"
+
+	orderIDKey       = attribute.Key("gophermart.order_id")
+	pendingOrdersKey = attribute.Key("gophermart.pending_orders")
+)
+
+const (
+	DefaultPollInterval         = time.Second
+	DefaultCallbackPollInterval = 30 * time.Second
+	DefaultCallbackReplayWindow = 5 * time.Minute
+	DefaultStuckCheckInterval   = time.Minute
+	DefaultRetryCount           = 3
+)
+
+func (i *orderInfo) String() string {
+	b, err := json.Marshal(i)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
 type Config struct {
-	BaseAddr string
-	Logger   *zap.Logger
+	BaseAddr     string
+	PollInterval time.Duration
+	// RetryCount is how many times a failed request to the accrual
+	// system is retried, zero disables retries. It is not defaulted,
+	// DefaultRetryCount is the default of the retry_count setting.
+	RetryCount int
+
+	CallbackSecret       []byte
+	CallbackReplayWindow time.Duration
+
+	// Schedule defines per-order polling cadence.
+	// DefaultSchedulePolicy is used if it is left empty.
+	Schedule SchedulePolicy
+
+	// StuckCheckInterval is how often unfinished orders older than
+	// Schedule.MaxAge are looked for and flagged as stuck.
+	StuckCheckInterval time.Duration
+
+	// Breaker configures the circuit breaker around the accrual system.
+	// DefaultBreakerConfig is used if it is left empty.
+	Breaker BreakerConfig
+
+	// RateLimit is the number of requests per second to the accrual
+	// system, zero means no limit. RateBurst defaults to DefaultRateBurst.
+	RateLimit float64
+	RateBurst int
+
+	// Events receives order status and balance changes, may be nil.
+	Events *events.Bus
+
+	// Metrics receives poll outcomes and the queue depth, may be nil.
+	Metrics *metrics.Metrics
+
+	Logger *zap.Logger
 	storage.AppStorage
 }
 
 type Updater struct {
-	ctx       context.Context
-	ctxCancel context.CancelFunc
+	// ctx is cancelled when the updater stops taking new work,
+	// workCtx is used by in-flight polls and cancelled only
+	// when they can't be drained in time.
+	ctx        context.Context
+	ctxCancel  context.CancelFunc
+	workCtx    context.Context
+	workCancel context.CancelFunc
+	wg         sync.WaitGroup
+
+	// unprocessed is the result of the cycle drained by Stop.
+	unprocessed int64
+	// startedAt, lastCycle and lastProgress are unix nanoseconds,
+	// lastCycle is 0 until the first successful cycle. lastProgress
+	// is updated when a cycle starts and after every polled order,
+	// so a long cycle isn't taken for a stuck one.
+	startedAt    int64
+	lastCycle    int64
+	lastProgress int64
+
 	client    *resty.Client
+	callbacks *signatureCache
+	breaker   *CircuitBreaker
+	limiter   *rate.Limiter
+
+	// tuning holds the current Tuning, the initial one
+	// is built from Config. retuned notifies the polling loop.
+	tuning  atomic.Value
+	retuned chan struct{}
 	Config
 }
 
+type statusError struct {
+	code int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("bad status code: %d", e.code)
+}
+
 func NewUpdater(ctx context.Context, cfg Config) *Updater {
-	ctx, cancel := context.WithCancel(ctx)
+	workCtx, workCancel := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancel(workCtx)
 
 	retryFunc := resty.RetryAfterFunc(func(client *resty.Client, response *resty.Response) (time.Duration, error) {
 		if response.StatusCode() != http.StatusTooManyRequests {
@@ -60,31 +161,99 @@ func NewUpdater(ctx context.Context, cfg Config) *Updater {
 		return time.Duration(seconds) * time.Second, nil
 	})
 
-	client := resty.New().SetRetryAfter(retryFunc).SetRetryCount(3)
+	if cfg.RetryCount < 0 {
+		cfg.RetryCount = 0
+	}
+	client := resty.New().SetRetryAfter(retryFunc).SetRetryCount(cfg.RetryCount)
+
+	if cfg.CallbackReplayWindow <= 0 {
+		cfg.CallbackReplayWindow = DefaultCallbackReplayWindow
+	}
+	if cfg.StuckCheckInterval <= 0 {
+		cfg.StuckCheckInterval = DefaultStuckCheckInterval
+	}
+
+	tuning := Tuning{
+		PollInterval: cfg.PollInterval,
+		RateLimit:    cfg.RateLimit,
+		RateBurst:    cfg.RateBurst,
+		Schedule:     cfg.Schedule,
+		Breaker:      cfg.Breaker,
+	}.withDefaults(len(cfg.CallbackSecret) != 0)
 
 	updater := &Updater{
-		ctx:       ctx,
-		ctxCancel: cancel,
-		client:    client,
-		Config:    cfg,
+		ctx:        ctx,
+		ctxCancel:  cancel,
+		workCtx:    workCtx,
+		workCancel: workCancel,
+		client:     client,
+		callbacks:  newSignatureCache(),
+		breaker:    NewCircuitBreaker(tuning.Breaker, cfg.Logger),
+		limiter:    rate.NewLimiter(rateLimit(tuning.RateLimit), tuning.RateBurst),
+		retuned:    make(chan struct{}, 1),
+		startedAt:  time.Now().UnixNano(),
+		Config:     cfg,
 	}
+	updater.tuning.Store(tuning)
 
+	updater.wg.Add(2)
 	go updater.updateOrders()
+	go updater.detectStuckOrders()
 
 	return updater
 }
 
-func (u *Updater) Stop() {
+// Stop makes the updater stop taking new work and waits until in-flight
+// polls persist their results. If ctx is done before that, in-flight
+// polls are aborted. Stop returns the number of orders polled by the
+// drained cycle whose results were left unprocessed, zero if no cycle
+// was in flight. Orders skipped while the circuit was open are not
+// counted, they were not polled.
+func (u *Updater) Stop(ctx context.Context) (int, error) {
 	u.ctxCancel()
+
+	done := make(chan struct{})
+	go func() {
+		u.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		u.workCancel()
+		<-done
+	}
+	u.workCancel()
+
+	return int(atomic.LoadInt64(&u.unprocessed)), err
 }
 
 func (u *Updater) updateOrders() {
-	ticker := time.NewTicker(time.Second)
+	defer u.wg.Done()
+
+	pollInterval := u.Tuning().PollInterval
+	ticker := time.NewTicker(pollInterval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			u.update()
+			if u.ctx.Err() != nil {
+				return
+			}
+			unprocessed := u.update()
+			if u.ctx.Err() != nil {
+				// Stop was called while the cycle was in flight.
+				atomic.StoreInt64(&u.unprocessed, int64(unprocessed))
+				return
+			}
+		case <-u.retuned:
+			if interval := u.Tuning().PollInterval; interval != pollInterval {
+				pollInterval = interval
+				ticker.Reset(pollInterval)
+			}
 		case <-u.ctx.Done():
 			return
 
@@ -92,77 +261,285 @@ func (u *Updater) updateOrders() {
 	}
 }
 
-func (u *Updater) update() {
-	orders, err := u.GetUnfinishedOrders(u.ctx)
+func (u *Updater) progress() {
+	atomic.StoreInt64(&u.lastProgress, time.Now().UnixNano())
+}
+
+func (u *Updater) BreakerState() BreakerSnapshot {
+	return u.breaker.Snapshot()
+}
+
+// update polls due orders and returns the number of polled orders
+// whose results were not persisted.
+func (u *Updater) update() int {
+	if !u.breaker.Ready() {
+		return 0
+	}
+
+	ctx, span := otel.Tracer(tracerName).Start(u.workCtx, "accrual.update")
+	defer span.End()
+	logger := u.Logger.With(tracing.LogFields(ctx)...)
+
+	orders, err := u.GetUnfinishedOrders(ctx)
 	if err != nil {
-		u.Logger.Error("failed to get unfinished orders", zap.Error(err))
-		return
+		logger.Error("failed to get unfinished orders", zap.Error(err))
+		return 0
 	}
+	// Failures of single orders are reported as unprocessed,
+	// the cycle itself has succeeded.
+	defer atomic.StoreInt64(&u.lastCycle, time.Now().UnixNano())
+	u.progress()
+
+	u.Metrics.SetPendingOrders(len(orders))
+	span.SetAttributes(pendingOrdersKey.Int(len(orders)))
 	if len(orders) == 0 {
-		u.Logger.Info("no orders to update")
-		return
+		logger.Info("no orders to update")
+		return 0
 	}
 
 	var wg sync.WaitGroup
 	ordersInfo := make([]*orderInfo, len(orders))
+	pollErrors := make([]error, len(orders))
 
+	persisted := make([]bool, len(orders))
+	skipped := make([]bool, len(orders))
+	statusChanged := make([]bool, len(orders))
 	ordersWithBalanceUpdate := make([]storage.Order, 0)
+	balanceUpdateIndexes := make([]int, 0)
+	schedules := make([]storage.OrderSchedule, 0, len(orders))
+	scheduleIndexes := make([]int, 0, len(orders))
 	for i, o := range orders {
 		wg.Add(1)
 		go func(index int, o storage.Order) {
 			defer wg.Done()
-			info, err := u.getOrderStatus(o.ID)
-			if err != nil {
-				u.Logger.Error("failed to get order info", zap.Int64("order_id", o.ID), zap.Error(err))
-				return
-			}
-			ordersInfo[index] = info
+			ordersInfo[index], pollErrors[index] = u.pollOrder(ctx, o.ID)
+			u.progress()
 		}(i, o)
 	}
 
 	wg.Wait()
 
+	now := time.Now()
+	schedule := u.Tuning().Schedule
 	for i, info := range ordersInfo {
 		if info == nil {
+			// Orders rejected by the open circuit were not polled at all,
+			// they stay due for the next cycle.
+			if errors.Is(pollErrors[i], ErrCircuitOpen) {
+				skipped[i] = true
+				continue
+			}
+			schedules = append(schedules, u.schedule(schedule, orders[i], now, pollErrors[i].Error()))
+			scheduleIndexes = append(scheduleIndexes, i)
 			continue
 		}
 
-		switch info.Status {
-		case StatusRegistered, StatusProcessing:
-			orders[i].Status = storage.StatusProcessing
-		case StatusInvalid:
-			orders[i].Status = storage.StatusInvalid
-		case StatusProcessed:
-			orders[i].Status = storage.StatusProcessed
-			orders[i].Accrual = info.Accrual
+		previousStatus := orders[i].Status
+		credit := applyOrderInfo(&orders[i], info)
+		statusChanged[i] = orders[i].Status != previousStatus
+		if credit {
+			ordersWithBalanceUpdate = append(ordersWithBalanceUpdate, orders[i])
+			balanceUpdateIndexes = append(balanceUpdateIndexes, i)
+			continue
 		}
 
-		if info.Status == storage.StatusProcessed {
-			ordersWithBalanceUpdate = append(ordersWithBalanceUpdate, orders[i])
+		if orders[i].Status != storage.StatusInvalid {
+			schedules = append(schedules, u.schedule(schedule, orders[i], now, info.String()))
+		}
+
+		if err := u.UpdateOrder(ctx, orders[i]); err != nil {
+			logger.Error("failed to update order", zap.Int64("order_id", orders[i].ID), zap.Error(err))
 			continue
 		}
+		persisted[i] = true
+	}
 
-		if err := u.UpdateOrder(u.ctx, orders[i]); err != nil {
-			u.Logger.Error("failed to update order", zap.Int64("order_id", orders[i].ID), zap.Error(err))
+	if _, err := u.UpdateBalanceFromOrders(ctx, ordersWithBalanceUpdate); err != nil {
+		logger.Error("failed to update user balance", zap.Error(err))
+	} else {
+		for _, i := range balanceUpdateIndexes {
+			persisted[i] = true
 		}
 	}
 
-	if err := u.UpdateBalanceFromOrders(u.ctx, ordersWithBalanceUpdate); err != nil {
-		u.Logger.Error("failed to update user balance", zap.Error(err))
+	if err := u.ScheduleOrders(ctx, schedules); err != nil {
+		logger.Error("failed to schedule orders", zap.Error(err))
+	} else {
+		for _, i := range scheduleIndexes {
+			persisted[i] = true
+		}
+	}
+
+	creditedUsers := make(map[int64]struct{})
+	unprocessed := 0
+	for i, p := range persisted {
+		if !p {
+			if !skipped[i] {
+				unprocessed++
+			}
+			continue
+		}
+		if statusChanged[i] {
+			u.publishOrderStatus(orders[i])
+		}
+		if orders[i].Status == storage.StatusProcessed {
+			creditedUsers[orders[i].UserID] = struct{}{}
+		}
+	}
+	for userID := range creditedUsers {
+		u.publishBalance(ctx, userID)
+	}
+
+	return unprocessed
+}
+
+func (u *Updater) publishOrderStatus(order storage.Order) {
+	if u.Events == nil {
+		return
+	}
+
+	u.Events.Publish(order.UserID, events.TypeOrderStatusChanged, events.OrderStatus{
+		Number:  strconv.FormatInt(order.ID, 10),
+		Status:  order.Status,
+		Accrual: order.Accrual,
+	})
+}
+
+func (u *Updater) publishBalance(ctx context.Context, userID int64) {
+	if u.Events == nil {
+		return
 	}
+
+	balance, err := u.GetBalance(ctx, userID)
+	if err != nil {
+		u.Logger.Error("failed to get balance for event", zap.Int64("user_id", userID), zap.Error(err))
+		return
+	}
+
+	u.Events.Publish(userID, events.TypeBalanceChanged, balance)
 }
 
-func (u *Updater) getOrderStatus(orderID int64) (*orderInfo, error) {
-	request := u.client.R().SetContext(u.ctx)
+func (u *Updater) schedule(policy SchedulePolicy, order storage.Order, now time.Time, lastResponse string) storage.OrderSchedule {
+	s := policy.Next(order, now)
+	s.LastResponse = lastResponse
+	if s.Stuck && !order.Stuck {
+		u.Logger.Warn("order is stuck",
+			zap.Int64("order_id", order.ID),
+			zap.Time("uploaded_at", order.UploadedAt),
+			zap.Int("attempts", order.Attempts))
+	}
+	return s
+}
 
+// applyOrderInfo maps the accrual system status onto the order.
+// It returns true if the order reached its final state with an accrual
+// that has to be credited to the user balance.
+func applyOrderInfo(order *storage.Order, info *orderInfo) bool {
+	switch info.Status {
+	case StatusRegistered, StatusProcessing:
+		order.Status = storage.StatusProcessing
+	case StatusInvalid:
+		order.Status = storage.StatusInvalid
+	case StatusProcessed:
+		order.Status = storage.StatusProcessed
+		order.Accrual = info.Accrual
+		return true
+	}
+
+	return false
+}
+
+// pollOrder requests the order status through the circuit breaker.
+// Failures of the accrual system itself are summarized by the breaker,
+// so only unexpected responses are logged per order.
+func (u *Updater) pollOrder(ctx context.Context, orderID int64) (*orderInfo, error) {
+	if err := u.limiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+
+	if !u.breaker.Allow() {
+		return nil, ErrCircuitOpen
+	}
+
+	info, err := u.getOrderStatus(ctx, orderID)
+	logger := u.Logger.With(tracing.LogFields(ctx)...)
+	if isCanceled(err) {
+		// The updater is stopping, the request tells nothing about
+		// the accrual system.
+		u.breaker.Release()
+		return nil, err
+	}
+	if err != nil && isAccrualFailure(err) {
+		u.breaker.Failure(err)
+		logger.Debug("failed to get order info", zap.Int64("order_id", orderID), zap.Error(err))
+		return nil, err
+	}
+
+	u.breaker.Success()
+	if err != nil {
+		// An order unknown to the accrual system is polled every cycle
+		// until it is registered there.
+		var se *statusError
+		if errors.As(err, &se) && se.code == http.StatusNoContent {
+			logger.Debug("order is not registered in the accrual system", zap.Int64("order_id", orderID))
+			return nil, err
+		}
+		logger.Error("failed to get order info", zap.Int64("order_id", orderID), zap.Error(err))
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// isAccrualFailure reports whether the error means the accrual system
+// is unavailable rather than it has no data for the order. Cancelled
+// requests are not failures.
+func isAccrualFailure(err error) bool {
+	if isCanceled(err) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= http.StatusInternalServerError || se.code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+func isCanceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (u *Updater) getOrderStatus(ctx context.Context, orderID int64) (_ *orderInfo, err error) {
 	url := fmt.Sprintf("%s/api/orders/%d", u.BaseAddr, orderID)
+
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "accrual.getOrderStatus",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			orderIDKey.Int64(orderID),
+			semconv.HTTPMethodKey.String(http.MethodGet),
+			semconv.HTTPURLKey.String(url),
+		))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	request := u.client.R().SetContext(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(request.Header))
+
 	response, err := request.Get(url)
 	if err != nil {
+		u.Metrics.AccrualPoll(0)
 		return nil, err
 	}
 
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(response.StatusCode()))
+	u.Metrics.AccrualPoll(response.StatusCode())
 	if response.StatusCode() != http.StatusOK {
-		return nil, fmt.Errorf("bad status code: %d", response.StatusCode())
+		return nil, &statusError{code: response.StatusCode()}
 	}
 
 	var info orderInfo
@@ -0,0 +1,74 @@
+package accrualsim
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	RewardPercent = "%"
+	RewardPoints  = "pt"
+
+	matchAny = "*"
+)
+
+var ErrBadRule = errors.New("bad reward rule")
+
+// RewardRule assigns a reward to orders whose number starts with Match.
+// Match "*" matches every order.
+type RewardRule struct {
+	Match      string
+	Amount     float64
+	RewardType string
+}
+
+func (r RewardRule) Matches(number string) bool {
+	return r.Match == matchAny || strings.HasPrefix(number, r.Match)
+}
+
+func (r RewardRule) Reward(purchase float64) float64 {
+	if r.RewardType == RewardPercent {
+		return float64(int64(purchase*r.Amount)) / 100
+	}
+	return r.Amount
+}
+
+// ParseRules parses a comma separated list of rules in the
+// "<prefix>:<amount><%|pt>" format, e.g. "4242:10%,*:50pt".
+// Rules are applied in the given order, the first match wins.
+func ParseRules(value string) ([]RewardRule, error) {
+	rules := make([]RewardRule, 0)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, ErrBadRule
+		}
+
+		rule := RewardRule{Match: parts[0]}
+		amount := parts[1]
+		switch {
+		case strings.HasSuffix(amount, RewardPercent):
+			rule.RewardType = RewardPercent
+		case strings.HasSuffix(amount, RewardPoints):
+			rule.RewardType = RewardPoints
+		default:
+			return nil, ErrBadRule
+		}
+
+		v, err := strconv.ParseFloat(strings.TrimSuffix(amount, rule.RewardType), 64)
+		if err != nil || v < 0 {
+			return nil, ErrBadRule
+		}
+		rule.Amount = v
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
@@ -0,0 +1,321 @@
+package accrualsim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/luhn"
+	"go.uber.org/zap"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	StatusRegistered = "REGISTERED"
+	StatusInvalid    = "INVALID"
+	StatusProcessing = "PROCESSING"
+	StatusProcessed  = "PROCESSED"
+)
+
+var (
+	ErrBadOrder      = errors.New("bad order number")
+	ErrBadStatus     = errors.New("scripted status must be INVALID or PROCESSED")
+	ErrAlreadyExists = errors.New("order is already registered")
+)
+
+// Config describes the simulated accrual system behaviour.
+type Config struct {
+	// Latency is added to every response, LatencyJitter is a random
+	// addition in [0, LatencyJitter).
+	Latency       time.Duration
+	LatencyJitter time.Duration
+
+	// An order is REGISTERED right after registration, becomes PROCESSING
+	// after ProcessingAfter and reaches its final status after ProcessedAfter.
+	ProcessingAfter time.Duration
+	ProcessedAfter  time.Duration
+
+	// AutoRegister registers unknown orders on the first request,
+	// otherwise such requests are answered with 204.
+	AutoRegister bool
+	// InvalidRate is a fraction of orders with valid numbers that become INVALID.
+	InvalidRate float64
+	Rules       []RewardRule
+
+	// RateLimit is the number of requests per minute, 0 means no limit.
+	RateLimit int
+
+	// ErrorRate is a fraction of requests answered with 500.
+	ErrorRate float64
+	// SlowRate is a fraction of requests delayed by SlowDelay on top of Latency.
+	SlowRate  float64
+	SlowDelay time.Duration
+
+	Seed   int64
+	Logger *zap.Logger
+}
+
+type order struct {
+	number       string
+	registeredAt time.Time
+	// status and accrual are set for scripted orders only.
+	status  string
+	accrual float64
+}
+
+type orderResponse struct {
+	Order   string  `json:"order"`
+	Status  string  `json:"status"`
+	Accrual float64 `json:"accrual,omitempty"`
+}
+
+type registerRequest struct {
+	Order   string   `json:"order"`
+	Status  string   `json:"status,omitempty"`
+	Accrual *float64 `json:"accrual,omitempty"`
+}
+
+type Simulator struct {
+	cfg Config
+
+	mu     sync.Mutex
+	orders map[string]*order
+	random *rand.Rand
+
+	windowStart time.Time
+	windowCount int
+}
+
+func New(cfg Config) *Simulator {
+	return &Simulator{
+		cfg:    cfg,
+		orders: make(map[string]*order),
+		random: rand.New(rand.NewSource(cfg.Seed)),
+	}
+}
+
+func (s *Simulator) Handler() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/api/orders/{number}", s.apiGetOrder)
+	r.Post("/api/orders", s.apiRegisterOrder)
+	return r
+}
+
+func (s *Simulator) apiGetOrder(w http.ResponseWriter, r *http.Request) {
+	if retryAfter, limited := s.rateLimited(time.Now()); limited {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		w.WriteHeader(http.StatusTooManyRequests)
+		fmt.Fprintf(w, "No more than %d requests per minute allowed", s.cfg.RateLimit)
+		return
+	}
+
+	delay, fail := s.faults()
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fail {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	number := chi.URLParam(r, "number")
+	o, exists := s.order(number)
+	if !exists {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	resp := s.evaluate(o, time.Now())
+	dst, err := json.Marshal(resp)
+	if err != nil {
+		s.cfg.Logger.Error("failed to marshal response", zap.Error(err))
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(dst); err != nil {
+		s.cfg.Logger.Error("failed to write response body", zap.Error(err))
+	}
+}
+
+// apiRegisterOrder registers an order, optionally with a scripted
+// final status and accrual, so scenarios can be set up from tests.
+func (s *Simulator) apiRegisterOrder(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	req := registerRequest{}
+	if err := json.Unmarshal(b, &req); err != nil {
+		http.Error(w, "", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.Register(req.Order, req.Status, req.Accrual); err != nil {
+		switch {
+		case errors.Is(err, ErrAlreadyExists):
+			http.Error(w, "", http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Register adds the order to the simulator. Empty status means the final
+// status and accrual are computed from the configured rules.
+func (s *Simulator) Register(number, status string, accrual *float64) error {
+	if _, err := strconv.ParseUint(number, 10, 64); err != nil {
+		return ErrBadOrder
+	}
+
+	o := &order{number: number, registeredAt: time.Now(), status: status}
+	switch status {
+	case "":
+	case StatusInvalid:
+	case StatusProcessed:
+		if accrual != nil {
+			o.accrual = *accrual
+		} else {
+			o.accrual = s.reward(number)
+		}
+	default:
+		return ErrBadStatus
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.orders[number]; exists {
+		return ErrAlreadyExists
+	}
+	s.orders[number] = o
+	return nil
+}
+
+func (s *Simulator) order(number string) (*order, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, exists := s.orders[number]
+	if !exists && s.cfg.AutoRegister {
+		o = &order{number: number, registeredAt: time.Now()}
+		s.orders[number] = o
+		exists = true
+	}
+	return o, exists
+}
+
+func (s *Simulator) evaluate(o *order, now time.Time) orderResponse {
+	resp := orderResponse{Order: o.number}
+
+	age := now.Sub(o.registeredAt)
+	switch {
+	case age < s.cfg.ProcessingAfter:
+		resp.Status = StatusRegistered
+		return resp
+	case age < s.cfg.ProcessedAfter:
+		resp.Status = StatusProcessing
+		return resp
+	}
+
+	if len(o.status) != 0 {
+		resp.Status = o.status
+		resp.Accrual = o.accrual
+		return resp
+	}
+
+	if !luhn.IsValid(o.number) || fraction(o.number, "invalid") < s.cfg.InvalidRate {
+		resp.Status = StatusInvalid
+		return resp
+	}
+
+	resp.Status = StatusProcessed
+	resp.Accrual = s.reward(o.number)
+	return resp
+}
+
+func (s *Simulator) reward(number string) float64 {
+	for _, rule := range s.cfg.Rules {
+		if rule.Matches(number) {
+			return rule.Reward(purchaseAmount(number))
+		}
+	}
+	return 0
+}
+
+// rateLimited counts the request in a fixed one minute window.
+func (s *Simulator) rateLimited(now time.Time) (time.Duration, bool) {
+	if s.cfg.RateLimit <= 0 {
+		return 0, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.windowStart) >= time.Minute {
+		s.windowStart = now
+		s.windowCount = 0
+	}
+
+	s.windowCount++
+	if s.windowCount <= s.cfg.RateLimit {
+		return 0, false
+	}
+
+	retryAfter := s.windowStart.Add(time.Minute).Sub(now).Round(time.Second)
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	return retryAfter, true
+}
+
+func (s *Simulator) faults() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delay := s.cfg.Latency
+	if s.cfg.LatencyJitter > 0 {
+		delay += time.Duration(s.random.Int63n(int64(s.cfg.LatencyJitter)))
+	}
+	if s.random.Float64() < s.cfg.SlowRate {
+		delay += s.cfg.SlowDelay
+	}
+
+	return delay, s.random.Float64() < s.cfg.ErrorRate
+}
+
+// purchaseAmount derives a stable purchase amount in [100, 10000)
+// from the order number, percentage rewards are computed from it.
+func purchaseAmount(number string) float64 {
+	return 100 + float64(hash(number, "amount")%990000)/100
+}
+
+// fraction maps the order number to a stable value in [0, 1).
+func fraction(number, salt string) float64 {
+	return float64(hash(number, salt)%10000) / 10000
+}
+
+func hash(number, salt string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(salt))
+	h.Write([]byte(number))
+	return h.Sum64()
+}
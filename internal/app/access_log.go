@@ -0,0 +1,158 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/logging"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/tracing"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	RequestIDHeader = "X-Request-ID"
+
+	maxRequestIDLength = 128
+	requestIDSize      = 16
+	redactedValue      = "REDACTED"
+)
+
+var (
+	RequestIDCtxKey = &contextKey{"RequestID"}
+	accessLogCtxKey = &contextKey{"AccessLog"}
+)
+
+// redactedQueryParams are replaced in logged URLs.
+var redactedQueryParams = map[string]bool{
+	"access_token": true,
+	"jwt":          true,
+	"password":     true,
+	"secret":       true,
+	"token":        true,
+}
+
+// accessLogEntry collects what inner handlers learn about the request,
+// it is shared through the context as they see a derived request.
+type accessLogEntry struct {
+	userID int64
+}
+
+// RequestID takes the request ID from the X-Request-ID header or generates
+// a new one if the header is missing or malformed. The ID is echoed back
+// in the response header.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if !isValidRequestID(requestID) {
+			requestID = newRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), RequestIDCtxKey, requestID)))
+	})
+}
+
+// AccessLog places the request-scoped logger into the context and writes
+// an entry per request once it is served. Credentials are never logged:
+// headers are left out and sensitive query parameters are redacted.
+func AccessLog(logger *zap.Logger) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			fields := tracing.LogFields(r.Context())
+			if requestID, ok := r.Context().Value(RequestIDCtxKey).(string); ok {
+				fields = append(fields, zap.String("request_id", requestID))
+			}
+			reqLogger := logger.With(fields...)
+
+			entry := &accessLogEntry{}
+			ctx := context.WithValue(r.Context(), accessLogCtxKey, entry)
+			ctx = logging.WithLogger(ctx, reqLogger)
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r.WithContext(ctx))
+
+			route := ""
+			if rctx := chi.RouteContext(r.Context()); rctx != nil {
+				route = rctx.RoutePattern()
+			}
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+
+			accessFields := []zap.Field{
+				zap.String("method", r.Method),
+				zap.String("route", route),
+				zap.String("uri", redactURI(r.URL)),
+				zap.Int("status", status),
+				zap.Int("bytes", ww.BytesWritten()),
+				zap.Duration("duration", time.Since(start)),
+				zap.String("remote_addr", r.RemoteAddr),
+				zap.String("user_agent", r.UserAgent()),
+			}
+			if entry.userID != 0 {
+				accessFields = append(accessFields, zap.Int64("user_id", entry.userID))
+			}
+
+			reqLogger.Info("request served", accessFields...)
+		})
+	}
+}
+
+// withRequestUser records the authorized user in the access log entry and
+// returns a context whose logger has the user ID.
+func withRequestUser(ctx context.Context, userID int64) context.Context {
+	if entry, ok := ctx.Value(accessLogCtxKey).(*accessLogEntry); ok {
+		entry.userID = userID
+	}
+
+	if logger := logging.FromContext(ctx, nil); logger != nil {
+		ctx = logging.WithLogger(ctx, logger.With(zap.Int64("user_id", userID)))
+	}
+	return ctx
+}
+
+func redactURI(u *url.URL) string {
+	if len(u.RawQuery) == 0 {
+		return u.Path
+	}
+
+	query := u.Query()
+	for name := range query {
+		if redactedQueryParams[strings.ToLower(name)] {
+			query[name] = []string{redactedValue}
+		}
+	}
+	return u.Path + "?" + query.Encode()
+}
+
+func isValidRequestID(id string) bool {
+	if len(id) == 0 || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, requestIDSize)
+	if _, err := rand.Read(b); err != nil {
+		// The ID only correlates log entries, the time is unique enough.
+		return strings.ReplaceAll(time.Now().UTC().Format("20060102150405.000000000"), ".", "")
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,234 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/events"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/logging"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AdminActorHeader  = "X-Operator"
+	defaultAdminActor = "admin"
+)
+
+type AdminServer struct {
+	ctx            context.Context
+	logger         *zap.Logger
+	storageService storage.AppStorage
+	events         *events.Bus
+}
+
+func NewAdminServer(ctx context.Context, logger *zap.Logger, storage storage.AppStorage, bus *events.Bus) (*AdminServer, error) {
+	server := &AdminServer{
+		ctx:            ctx,
+		logger:         logger,
+		storageService: storage,
+		events:         bus,
+	}
+
+	return server, nil
+}
+
+func (s *AdminServer) apiGetStuckOrders(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
+	orders, err := s.storageService.GetStuckOrders(r.Context())
+	if err != nil {
+		logger.Error("failed to get stuck orders", zap.Error(err))
+		writeError(w, r, err)
+		return
+	}
+
+	respData := make([]stuckOrderResponse, len(orders))
+	for i, e := range orders {
+		respData[i] = stuckOrderResponse{
+			Number:              strconv.FormatInt(e.ID, 10),
+			UserID:              e.UserID,
+			Status:              e.Status,
+			Accrual:             e.Accrual,
+			UploadedAt:          e.UploadedAt,
+			UpdatedAt:           e.UpdatedAt,
+			Attempts:            e.Attempts,
+			LastAccrualResponse: e.LastResponse,
+		}
+		if !e.LastPolledAt.IsZero() {
+			lastPolledAt := e.LastPolledAt
+			respData[i].LastPolledAt = &lastPolledAt
+		}
+	}
+
+	s.apiWriteResponse(w, r, http.StatusOK, respData)
+}
+
+func (s *AdminServer) apiRepollOrder(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
+	orderID, err := strconv.ParseInt(chi.URLParam(r, "number"), 10, 64)
+	if err != nil {
+		writeError(w, r, ErrBadRouteParameter)
+		return
+	}
+
+	if err := s.storageService.RepollOrder(r.Context(), orderID); err != nil {
+		s.apiWriteResolutionError(w, r, orderID, err)
+		return
+	}
+
+	logger.Info("order re-poll requested",
+		zap.Int64("order_id", orderID),
+		zap.String("actor", adminActor(r)))
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *AdminServer) apiInvalidateOrder(w http.ResponseWriter, r *http.Request) {
+	s.apiResolveOrder(w, r, storage.OrderActionInvalidate)
+}
+
+func (s *AdminServer) apiCreditOrder(w http.ResponseWriter, r *http.Request) {
+	s.apiResolveOrder(w, r, storage.OrderActionCredit)
+}
+
+func (s *AdminServer) apiResolveOrder(w http.ResponseWriter, r *http.Request, action string) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
+	orderID, err := strconv.ParseInt(chi.URLParam(r, "number"), 10, 64)
+	if err != nil {
+		writeError(w, r, ErrBadRouteParameter)
+		return
+	}
+
+	req := orderResolutionRequest{}
+	if err := s.apiParseRequest(r, &req); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if len(strings.TrimSpace(req.Reason)) == 0 {
+		logger.Error("order resolution without reason", zap.Int64("order_id", orderID))
+		writeError(w, r, ErrMissingReason)
+		return
+	}
+
+	resolution := storage.OrderResolution{
+		OrderID: orderID,
+		Status:  storage.StatusInvalid,
+		Action:  action,
+		Actor:   adminActor(r),
+		Reason:  req.Reason,
+	}
+
+	if action == storage.OrderActionCredit {
+		if req.Accrual <= 0 {
+			logger.Error("bad manual accrual", zap.Int64("order_id", orderID), zap.Float64("accrual", req.Accrual))
+			writeError(w, r, ErrBadAccrual)
+			return
+		}
+		resolution.Status = storage.StatusProcessed
+		resolution.Accrual = req.Accrual
+	}
+
+	order, err := s.storageService.ResolveOrder(r.Context(), resolution)
+	if err != nil {
+		s.apiWriteResolutionError(w, r, orderID, err)
+		return
+	}
+
+	logger.Info("order resolved manually",
+		zap.Int64("order_id", orderID),
+		zap.String("action", resolution.Action),
+		zap.String("actor", resolution.Actor),
+		zap.String("reason", resolution.Reason),
+		zap.Float64("accrual", resolution.Accrual))
+
+	w.WriteHeader(http.StatusOK)
+
+	publishOrderStatus(s.events, *order)
+	if order.Status == storage.StatusProcessed {
+		publishBalance(r.Context(), logger, s.storageService, s.events, order.UserID)
+	}
+}
+
+func (s *AdminServer) apiWriteResolutionError(w http.ResponseWriter, r *http.Request, orderID int64, err error) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
+	if !errors.Is(err, storage.ErrNoSuchOrder) && !errors.Is(err, storage.ErrOrderFinalized) {
+		logger.Error("failed to resolve order", zap.Int64("order_id", orderID), zap.Error(err))
+	}
+	writeError(w, r, err)
+}
+
+func (s *AdminServer) apiParseRequest(r *http.Request, body interface{}) error {
+	logger := logging.FromContext(r.Context(), s.logger)
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+		logger.Error("bad content type", zap.String("content_type", contentType))
+		return ErrBadContentType
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Error("failed to read request body", zap.Error(err))
+		return fmt.Errorf("%w: %v", ErrBadRequestBody, err)
+	}
+
+	if err = json.Unmarshal(b, &body); err != nil {
+		logger.Error("failed to unmarshal request json", zap.Error(err))
+		return ErrBodyUnmarshal
+	}
+
+	return nil
+}
+
+func (s *AdminServer) apiWriteResponse(w http.ResponseWriter, r *http.Request, statusCode int, response interface{}) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
+	dst, err := json.Marshal(response)
+	if err != nil {
+		logger.Error("failed to marshal response", zap.Error(err))
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	if _, err := w.Write(dst); err != nil {
+		logger.Error("failed to write response body", zap.Error(err))
+	}
+}
+
+func adminActor(r *http.Request) string {
+	if actor := strings.TrimSpace(r.Header.Get(AdminActorHeader)); len(actor) != 0 {
+		return actor
+	}
+	return defaultAdminActor
+}
+
+type stuckOrderResponse struct {
+	Number              string     `json:"number"`
+	UserID              int64      `json:"user_id"`
+	Status              string     `json:"status"`
+	Accrual             float64    `json:"accrual,omitempty"`
+	UploadedAt          time.Time  `json:"uploaded_at"`
+	UpdatedAt           time.Time  `json:"updated_at"`
+	Attempts            int        `json:"attempts"`
+	LastPolledAt        *time.Time `json:"last_polled_at,omitempty"`
+	LastAccrualResponse string     `json:"last_accrual_response,omitempty"`
+}
+
+type orderResolutionRequest struct {
+	Reason  string  `json:"reason"`
+	Accrual float64 `json:"accrual"`
+}
@@ -5,11 +5,14 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/go-chi/jwtauth"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/logging"
 	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
 	"go.uber.org/zap"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -25,23 +28,27 @@ type AuthServer struct {
 	logger      *zap.Logger
 	userStorage storage.AppStorage
 	authorizer  *jwtauth.JWTAuth
+	lockout     *loginLockout
 }
 
-func NewAuthServer(ctx context.Context, logger *zap.Logger, userStorage storage.AppStorage, authorizer *jwtauth.JWTAuth) (*AuthServer, error) {
+func NewAuthServer(ctx context.Context, logger *zap.Logger, userStorage storage.AppStorage, authorizer *jwtauth.JWTAuth, lockout *loginLockout) (*AuthServer, error) {
 	server := &AuthServer{
 		ctx:         ctx,
 		logger:      logger,
 		userStorage: userStorage,
 		authorizer:  authorizer,
+		lockout:     lockout,
 	}
 
 	return server, nil
 }
 
 func (s *AuthServer) apiUserRegister(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
 	authData := userAuthRequest{}
 	if err := s.apiParseRequest(r, &authData); err != nil {
-		http.Error(w, "", http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
@@ -49,23 +56,24 @@ func (s *AuthServer) apiUserRegister(w http.ResponseWriter, r *http.Request) {
 		UserName: authData.Login,
 		Secret:   []byte(authData.Password),
 	}); err != nil {
-		if errors.Is(err, storage.ErrDuplicateUser) {
-			http.Error(w, "", http.StatusConflict)
-			return
+		if !errors.Is(err, storage.ErrDuplicateUser) {
+			logger.Error("failed to add user", zap.Error(err))
 		}
-		http.Error(w, "", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
 	userData, err := s.userStorage.GetUserAuthInfo(r.Context(), authData.Login)
 	if err != nil {
-		http.Error(w, "", http.StatusInternalServerError)
+		logger.Error("failed to get user info from DB", zap.Error(err))
+		writeError(w, r, err)
 		return
 	}
 
 	_, value, err := s.authorizer.Encode(map[string]interface{}{"id": userData.ID, "ts": time.Now().Unix()})
 	if err != nil {
-		http.Error(w, "", http.StatusInternalServerError)
+		logger.Error("failed to encode JWT", zap.Error(err))
+		writeError(w, r, err)
 		return
 	}
 
@@ -80,27 +88,42 @@ func (s *AuthServer) apiUserRegister(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *AuthServer) apiUserLogin(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
 	authData := userAuthRequest{}
 	if err := s.apiParseRequest(r, &authData); err != nil {
-		http.Error(w, "", http.StatusBadRequest)
+		writeError(w, r, err)
+		return
+	}
+
+	if remaining := s.lockout.locked(authData.Login); remaining > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(remaining)))
+		writeError(w, r, ErrLoginLocked)
 		return
 	}
 
 	dbUserData, err := s.userStorage.GetUserAuthInfo(r.Context(), authData.Login)
 	if err != nil {
-		s.logger.Error("Failed to get user info from DB", zap.Error(err))
-		http.Error(w, "", http.StatusUnauthorized)
+		if errors.Is(err, storage.ErrNoSuchUser) {
+			s.lockout.fail(authData.Login)
+		} else {
+			logger.Error("Failed to get user info from DB", zap.Error(err))
+		}
+		writeError(w, r, err)
 		return
 	}
 
 	if !bytes.Equal(dbUserData.Secret, []byte(authData.Password)) {
-		http.Error(w, "", http.StatusUnauthorized)
+		s.lockout.fail(authData.Login)
+		writeError(w, r, ErrInvalidCredentials)
 		return
 	}
+	s.lockout.succeed(authData.Login)
 
 	_, value, err := s.authorizer.Encode(map[string]interface{}{"id": dbUserData.ID, "ts": time.Now().Unix()})
 	if err != nil {
-		http.Error(w, "", http.StatusInternalServerError)
+		logger.Error("failed to encode JWT", zap.Error(err))
+		writeError(w, r, err)
 		return
 	}
 
@@ -115,19 +138,21 @@ func (s *AuthServer) apiUserLogin(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *AuthServer) apiParseRequest(r *http.Request, body interface{}) error {
+	logger := logging.FromContext(r.Context(), s.logger)
+
 	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
-		s.logger.Error("bad content type", zap.String("content_type", contentType))
+		logger.Error("bad content type", zap.String("content_type", contentType))
 		return ErrBadContentType
 	}
 
 	b, err := io.ReadAll(r.Body)
 	if err != nil {
-		s.logger.Error("failed to read request body", zap.Error(err))
-		return err
+		logger.Error("failed to read request body", zap.Error(err))
+		return fmt.Errorf("%w: %v", ErrBadRequestBody, err)
 	}
 
 	if err = json.Unmarshal(b, &body); err != nil {
-		s.logger.Error("failed to unmarshal request json", zap.Error(err))
+		logger.Error("failed to unmarshal request json", zap.Error(err))
 		return ErrBodyUnmarshal
 	}
 
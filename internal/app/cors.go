@@ -0,0 +1,66 @@
+package app
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const corsMaxAge = 10 * 60
+
+var (
+	corsAllowedMethods = strings.Join([]string{http.MethodGet, http.MethodPost}, ", ")
+	corsAllowedHeaders = strings.Join([]string{
+		"Authorization", "Content-Type", "Content-Encoding", "If-None-Match", "Last-Event-ID", RequestIDHeader,
+	}, ", ")
+	corsExposedHeaders = strings.Join([]string{
+		"ETag", "Retry-After", RequestIDHeader,
+		RateLimitLimitHeader, RateLimitRemainingHeader, RateLimitResetHeader, RateLimitPolicyHeader,
+	}, ", ")
+)
+
+// cors lets browsers on the allowed origins call the API with credentials.
+// The origins are read on every request and matched exactly, there is no
+// wildcard as the jwt cookie would be sent from any site. Preflight
+// requests are answered before routing, as no route accepts OPTIONS.
+func (s *Server) cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if !originAllowed(s.Tuning().CORSOrigins, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Allow-Credentials", "true")
+
+		if r.Method == http.MethodOptions && len(r.Header.Get("Access-Control-Request-Method")) != 0 {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+			h.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			h.Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func originAllowed(allowed []string, origin string) bool {
+	for _, o := range allowed {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
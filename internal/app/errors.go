@@ -3,8 +3,32 @@ package app
 import "errors"
 
 var (
-	ErrBadContentType  = errors.New("bad content type in request")
-	ErrBodyUnmarshal   = errors.New("failed to unmarshal request body")
-	ErrMissedJWTKey    = errors.New("failed to get data from JWT")
-	ErrJWTKeyBadFormat = errors.New("JWT key data has unexpected type")
+	ErrBadContentType       = errors.New("bad content type in request")
+	ErrBodyUnmarshal        = errors.New("failed to unmarshal request body")
+	ErrBadRequestBody       = errors.New("failed to read request body")
+	ErrRequestBodyTooLarge  = errors.New("request body is too large")
+	ErrBadContentEncoding   = errors.New("failed to decompress request body")
+	ErrBadOrderNumberFormat = errors.New("order number is not a decimal number")
+	ErrBadRouteParameter    = errors.New("bad route parameter")
+	ErrSchemaViolation      = errors.New("request does not match API schema")
+	ErrBadBatchSize         = errors.New("batch must contain from 1 to 1000 orders")
+	ErrBadLastEventID       = errors.New("bad Last-Event-ID header")
+	ErrUnknownEventType     = errors.New("unknown event type")
+	ErrBadExportFormat      = errors.New("format must be csv, json or ndjson")
+	ErrBadExportRange       = errors.New("from and to must be RFC 3339 timestamps or dates, from must precede to")
+	ErrBadWSCommand         = errors.New("action must be subscribe or unsubscribe")
+	ErrInvalidOrderNumber   = errors.New("order number failed Luhn check")
+	ErrMissingReason        = errors.New("reason is required")
+	ErrBadAccrual           = errors.New("accrual must be positive")
+	ErrInvalidCredentials   = errors.New("invalid login or password")
+	ErrUnauthorized         = errors.New("user is not authorized")
+	ErrClientCertRequired   = errors.New("verified client certificate is required")
+	ErrRateLimited          = errors.New("request rate limit exceeded")
+	ErrLoginLocked          = errors.New("login is locked after failed attempts")
+	ErrOrderAccessDenied    = errors.New("order belongs to another user")
+	ErrMissedJWTKey         = errors.New("failed to get data from JWT")
+	ErrJWTKeyBadFormat      = errors.New("JWT key data has unexpected type")
+	ErrRouteNotFound        = errors.New("route not found")
+	ErrMethodNotAllowed     = errors.New("method not allowed")
+	ErrStreamingUnsupported = errors.New("streaming is not supported")
 )
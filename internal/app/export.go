@@ -0,0 +1,272 @@
+package app
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/logging"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	ExportFormatCSV    = "csv"
+	ExportFormatJSON   = "json"
+	ExportFormatNDJSON = "ndjson"
+
+	exportDateLayout = "2006-01-02"
+	// exportFlushEvery is the number of entries written between flushes.
+	exportFlushEvery = 100
+)
+
+type historyEntryResponse struct {
+	Type    string    `json:"type"`
+	Number  string    `json:"number"`
+	Status  string    `json:"status,omitempty"`
+	Accrual float64   `json:"accrual,omitempty"`
+	Sum     float64   `json:"sum,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// historyWriter encodes history entries in one of the export formats.
+type historyWriter interface {
+	contentType() string
+	begin() error
+	write(e historyEntryResponse) error
+	end() error
+}
+
+func (s *MartServer) apiExportUserHistory(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	format := r.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = ExportFormatCSV
+	}
+
+	filter, err := parseHistoryFilter(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	hw, err := newHistoryWriter(format, w)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	started := false
+	written := 0
+	start := func() error {
+		started = true
+		w.Header().Set("Content-Type", hw.contentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, exportFilename(format, filter)))
+		w.WriteHeader(http.StatusOK)
+		return hw.begin()
+	}
+
+	err = s.storageService.ExportHistory(r.Context(), userData.ID, filter, func(e storage.HistoryEntry) error {
+		if !started {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+
+		if err := hw.write(historyEntryResponse{
+			Type:    e.Kind,
+			Number:  strconv.FormatInt(e.Number, 10),
+			Status:  e.Status,
+			Accrual: e.Accrual,
+			Sum:     e.Sum,
+			Time:    e.Time,
+		}); err != nil {
+			return err
+		}
+
+		written++
+		if flusher != nil && written%exportFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("failed to export history", zap.Int64("user_id", userData.ID), zap.Int("written", written), zap.Error(err))
+		if !started {
+			writeError(w, r, err)
+		}
+		// The response is already being sent, the client gets a truncated document.
+		return
+	}
+
+	if !started {
+		if err := start(); err != nil {
+			return
+		}
+	}
+	if err := hw.end(); err != nil {
+		logger.Error("failed to finish history export", zap.Int64("user_id", userData.ID), zap.Error(err))
+	}
+}
+
+// parseHistoryFilter reads the [from, to) range from the query. Bounds are
+// either RFC 3339 timestamps or dates, a date in "to" includes the whole day.
+func parseHistoryFilter(r *http.Request) (storage.HistoryFilter, error) {
+	filter := storage.HistoryFilter{}
+
+	if value := r.URL.Query().Get("from"); len(value) != 0 {
+		from, _, err := parseExportTime(value)
+		if err != nil {
+			return filter, err
+		}
+		filter.From = from
+	}
+
+	if value := r.URL.Query().Get("to"); len(value) != 0 {
+		to, dateOnly, err := parseExportTime(value)
+		if err != nil {
+			return filter, err
+		}
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+		filter.To = to
+	}
+
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return filter, ErrBadExportRange
+	}
+
+	return filter, nil
+}
+
+func parseExportTime(value string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, false, nil
+	}
+	if t, err := time.Parse(exportDateLayout, value); err == nil {
+		return t, true, nil
+	}
+	return time.Time{}, false, ErrBadExportRange
+}
+
+func exportFilename(format string, filter storage.HistoryFilter) string {
+	name := "gophermart-history"
+	if !filter.From.IsZero() {
+		name += "-from-" + filter.From.Format(exportDateLayout)
+	}
+	if !filter.To.IsZero() {
+		// The upper bound is exclusive, name the last day included.
+		name += "-to-" + filter.To.Add(-time.Nanosecond).Format(exportDateLayout)
+	}
+	return name + "." + format
+}
+
+func newHistoryWriter(format string, w io.Writer) (historyWriter, error) {
+	switch format {
+	case ExportFormatCSV:
+		return &csvHistoryWriter{w: csv.NewWriter(w)}, nil
+	case ExportFormatJSON:
+		return &jsonHistoryWriter{w: w}, nil
+	case ExportFormatNDJSON:
+		return &ndjsonHistoryWriter{enc: json.NewEncoder(w)}, nil
+	}
+	return nil, ErrBadExportFormat
+}
+
+type csvHistoryWriter struct {
+	w *csv.Writer
+}
+
+func (h *csvHistoryWriter) contentType() string {
+	return "text/csv"
+}
+
+func (h *csvHistoryWriter) begin() error {
+	return h.w.Write([]string{"type", "number", "status", "accrual", "sum", "time"})
+}
+
+func (h *csvHistoryWriter) write(e historyEntryResponse) error {
+	if err := h.w.Write([]string{
+		e.Type,
+		e.Number,
+		e.Status,
+		strconv.FormatFloat(e.Accrual, 'f', -1, 64),
+		strconv.FormatFloat(e.Sum, 'f', -1, 64),
+		e.Time.Format(time.RFC3339),
+	}); err != nil {
+		return err
+	}
+
+	h.w.Flush()
+	return h.w.Error()
+}
+
+func (h *csvHistoryWriter) end() error {
+	h.w.Flush()
+	return h.w.Error()
+}
+
+// jsonHistoryWriter writes a JSON array entry by entry.
+type jsonHistoryWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (h *jsonHistoryWriter) contentType() string {
+	return "application/json"
+}
+
+func (h *jsonHistoryWriter) begin() error {
+	_, err := io.WriteString(h.w, "[")
+	return err
+}
+
+func (h *jsonHistoryWriter) write(e historyEntryResponse) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if h.count != 0 {
+		if _, err := io.WriteString(h.w, ","); err != nil {
+			return err
+		}
+	}
+	h.count++
+
+	_, err = h.w.Write(b)
+	return err
+}
+
+func (h *jsonHistoryWriter) end() error {
+	_, err := io.WriteString(h.w, "]")
+	return err
+}
+
+type ndjsonHistoryWriter struct {
+	enc *json.Encoder
+}
+
+func (h *ndjsonHistoryWriter) contentType() string {
+	return "application/x-ndjson"
+}
+
+func (h *ndjsonHistoryWriter) begin() error {
+	return nil
+}
+
+func (h *ndjsonHistoryWriter) write(e historyEntryResponse) error {
+	return h.enc.Encode(e)
+}
+
+func (h *ndjsonHistoryWriter) end() error {
+	return nil
+}
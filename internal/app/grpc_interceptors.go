@@ -0,0 +1,182 @@
+package app
+
+import (
+	"context"
+	"github.com/go-chi/jwtauth"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/logging"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/ratelimit"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/tracing"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	// Registers the gzip compressor, clients may compress requests
+	// and ask for compressed responses like with the HTTP API.
+	_ "google.golang.org/grpc/encoding/gzip"
+)
+
+const (
+	grpcAuthorizationMetadata = "authorization"
+	grpcRequestIDMetadata     = "x-request-id"
+)
+
+// grpcPublicMethods don't require authorization.
+var grpcPublicMethods = map[string]bool{
+	"/gophermart.Gophermart/Register": true,
+	"/gophermart.Gophermart/Login":    true,
+}
+
+// GRPCLoggingInterceptor is the gRPC counterpart of RequestID and AccessLog.
+// The request ID is passed in the "x-request-id" metadata.
+func GRPCLoggingInterceptor(logger *zap.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		var requestID string
+		if values := md.Get(grpcRequestIDMetadata); len(values) != 0 && isValidRequestID(values[0]) {
+			requestID = values[0]
+		} else {
+			requestID = newRequestID()
+		}
+		_ = grpc.SetHeader(ctx, metadata.Pairs(grpcRequestIDMetadata, requestID))
+
+		reqLogger := logger.With(append(tracing.LogFields(ctx), zap.String("request_id", requestID))...)
+
+		entry := &accessLogEntry{}
+		ctx = context.WithValue(ctx, RequestIDCtxKey, requestID)
+		ctx = context.WithValue(ctx, accessLogCtxKey, entry)
+		ctx = logging.WithLogger(ctx, reqLogger)
+
+		resp, err := handler(ctx, req)
+
+		fields := []zap.Field{
+			zap.String("method", info.FullMethod),
+			zap.String("code", status.Code(err).String()),
+			zap.Duration("duration", time.Since(start)),
+		}
+		if entry.userID != 0 {
+			fields = append(fields, zap.Int64("user_id", entry.userID))
+		}
+		reqLogger.Info("gRPC request", fields...)
+
+		return resp, err
+	}
+}
+
+func GRPCTimeoutInterceptor(timeout func() time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout())
+		defer cancel()
+		return handler(ctx, req)
+	}
+}
+
+// GRPCAuthInterceptor is the gRPC counterpart of jwtauth.Verifier and
+// AuthorizationVerifier. The token is taken from the "authorization"
+// metadata in the "Bearer <token>" form.
+func GRPCAuthInterceptor(st storage.AppStorage, authorizer *jwtauth.JWTAuth) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if grpcPublicMethods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		values := md.Get(grpcAuthorizationMetadata)
+		if len(values) == 0 || !strings.HasPrefix(values[0], bearerPrefix) {
+			return nil, grpcError(ErrUnauthorized)
+		}
+
+		token, err := jwtauth.VerifyToken(authorizer, strings.TrimPrefix(values[0], bearerPrefix))
+		if err != nil {
+			return nil, grpcError(ErrUnauthorized)
+		}
+
+		claims, err := token.AsMap(ctx)
+		if err != nil {
+			return nil, grpcError(ErrUnauthorized)
+		}
+
+		userData, err := authorizeUser(ctx, st, claims)
+		if err != nil {
+			return nil, grpcError(err)
+		}
+
+		ctx = context.WithValue(ctx, UserAuthDataCtxKey, userData)
+		return handler(withRequestUser(ctx, userData.ID), req)
+	}
+}
+
+// grpcLimitedMethods are limited by a policy on top of the user policy.
+var grpcLimitedMethods = map[string]func(RateLimitConfig) (string, ratelimit.Policy){
+	"/gophermart.Gophermart/UploadOrder": func(c RateLimitConfig) (string, ratelimit.Policy) { return "orders", c.Orders },
+	"/gophermart.Gophermart/Withdraw":    func(c RateLimitConfig) (string, ratelimit.Policy) { return "withdraw", c.Withdraw },
+}
+
+// GRPCRateLimitInterceptor is the gRPC counterpart of the RateLimit
+// middleware sharing its store and buckets. Register and Login are keyed
+// by the peer IP, other methods by the user, so it must follow
+// GRPCAuthInterceptor. The limits are returned in the response header
+// metadata, RESOURCE_EXHAUSTED carries RetryInfo.
+func GRPCRateLimitInterceptor(cfg RateLimitConfig, logger *zap.Logger) grpc.UnaryServerInterceptor {
+	login := newLimiter(cfg.Store, "login", cfg.Login, logger)
+	user := newLimiter(cfg.Store, "user", cfg.User, logger)
+	methods := make(map[string]*limiter)
+	for method, policy := range grpcLimitedMethods {
+		name, p := policy(cfg)
+		if l := newLimiter(cfg.Store, name, p, logger); l != nil {
+			methods[method] = l
+		}
+	}
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var (
+			limiters []*limiter
+			key      string
+		)
+		if grpcPublicMethods[info.FullMethod] {
+			if p, ok := peer.FromContext(ctx); ok {
+				if addr, err := netip.ParseAddrPort(p.Addr.String()); err == nil {
+					key = addr.Addr().Unmap().String()
+				}
+			}
+			limiters = []*limiter{login}
+		} else {
+			if userData, ok := ctx.Value(UserAuthDataCtxKey).(*storage.UserAuthorization); ok {
+				key = strconv.FormatInt(userData.ID, 10)
+			}
+			limiters = []*limiter{user, methods[info.FullMethod]}
+		}
+		if len(key) == 0 {
+			return handler(ctx, req)
+		}
+
+		for _, l := range limiters {
+			if l == nil {
+				continue
+			}
+			result, ok := l.take(ctx, key)
+			if !ok {
+				continue
+			}
+
+			md := metadata.MD{}
+			for _, header := range l.headers(result) {
+				md.Set(header[0], header[1])
+			}
+			_ = grpc.SetHeader(ctx, md)
+
+			if !result.Allowed {
+				return nil, grpcRetryError(ErrRateLimited, result.RetryAfter)
+			}
+		}
+		return handler(ctx, req)
+	}
+}
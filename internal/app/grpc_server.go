@@ -0,0 +1,264 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/go-chi/jwtauth"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/events"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/logging"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/luhn"
+	pb "github.com/r4start/go-musthave-diploma-tpl/internal/proto"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const grpcErrorDomain = "gophermart"
+
+// GRPCServer implements the gRPC API on top of the same storage
+// and tokens as the HTTP API.
+type GRPCServer struct {
+	pb.UnimplementedGophermartServer
+
+	ctx            context.Context
+	logger         *zap.Logger
+	storageService storage.AppStorage
+	authorizer     *jwtauth.JWTAuth
+	events         *events.Bus
+	lockout        *loginLockout
+}
+
+func NewGRPCServer(ctx context.Context, logger *zap.Logger, storage storage.AppStorage, authorizer *jwtauth.JWTAuth, bus *events.Bus, lockout *loginLockout) (*GRPCServer, error) {
+	server := &GRPCServer{
+		ctx:            ctx,
+		logger:         logger,
+		storageService: storage,
+		authorizer:     authorizer,
+		events:         bus,
+		lockout:        lockout,
+	}
+
+	return server, nil
+}
+
+func (s *GRPCServer) Register(ctx context.Context, req *pb.AuthRequest) (*pb.AuthResponse, error) {
+	logger := logging.FromContext(ctx, s.logger)
+
+	if err := s.storageService.AddUser(ctx, &storage.UserAuthorization{
+		UserName: req.Login,
+		Secret:   []byte(req.Password),
+	}); err != nil {
+		if !errors.Is(err, storage.ErrDuplicateUser) {
+			logger.Error("failed to add user", zap.Error(err))
+		}
+		return nil, grpcError(err)
+	}
+
+	userData, err := s.storageService.GetUserAuthInfo(ctx, req.Login)
+	if err != nil {
+		logger.Error("failed to get user info from DB", zap.Error(err))
+		return nil, grpcError(err)
+	}
+
+	return s.authResponse(ctx, userData.ID)
+}
+
+func (s *GRPCServer) Login(ctx context.Context, req *pb.AuthRequest) (*pb.AuthResponse, error) {
+	logger := logging.FromContext(ctx, s.logger)
+
+	if remaining := s.lockout.locked(req.Login); remaining > 0 {
+		return nil, grpcRetryError(ErrLoginLocked, remaining)
+	}
+
+	userData, err := s.storageService.GetUserAuthInfo(ctx, req.Login)
+	if err != nil {
+		if errors.Is(err, storage.ErrNoSuchUser) {
+			s.lockout.fail(req.Login)
+		} else {
+			logger.Error("failed to get user info from DB", zap.Error(err))
+		}
+		return nil, grpcError(err)
+	}
+
+	if !bytes.Equal(userData.Secret, []byte(req.Password)) {
+		s.lockout.fail(req.Login)
+		return nil, grpcError(ErrInvalidCredentials)
+	}
+	s.lockout.succeed(req.Login)
+
+	return s.authResponse(ctx, userData.ID)
+}
+
+func (s *GRPCServer) UploadOrder(ctx context.Context, req *pb.UploadOrderRequest) (*pb.UploadOrderResponse, error) {
+	logger := logging.FromContext(ctx, s.logger)
+
+	userData := ctx.Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	orderID, err := parseOrderNumber(req.Number)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	err = s.storageService.AddOrder(ctx, userData.ID, orderID)
+	if errors.Is(err, storage.ErrOrderAlreadyPlaced) {
+		return &pb.UploadOrderResponse{AlreadyUploaded: true}, nil
+	}
+	if err != nil {
+		if !errors.Is(err, storage.ErrDuplicateOrder) {
+			logger.Error("failed to add order", zap.Int64("order_id", orderID), zap.Error(err))
+		}
+		return nil, grpcError(err)
+	}
+
+	return &pb.UploadOrderResponse{}, nil
+}
+
+func (s *GRPCServer) ListOrders(ctx context.Context, _ *pb.ListOrdersRequest) (*pb.ListOrdersResponse, error) {
+	logger := logging.FromContext(ctx, s.logger)
+
+	userData := ctx.Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	orders, err := s.storageService.GetOrders(ctx, userData.ID)
+	if err != nil {
+		logger.Error("get orders failed", zap.Error(err))
+		return nil, grpcError(err)
+	}
+
+	resp := &pb.ListOrdersResponse{Orders: make([]*pb.Order, len(orders))}
+	for i, e := range orders {
+		resp.Orders[i] = &pb.Order{
+			Number:     strconv.FormatInt(e.ID, 10),
+			Status:     e.Status,
+			Accrual:    e.Accrual,
+			UploadedAt: timestamppb.New(e.UploadedAt),
+		}
+	}
+
+	return resp, nil
+}
+
+func (s *GRPCServer) GetBalance(ctx context.Context, _ *pb.GetBalanceRequest) (*pb.GetBalanceResponse, error) {
+	logger := logging.FromContext(ctx, s.logger)
+
+	userData := ctx.Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	balance, err := s.storageService.GetBalance(ctx, userData.ID)
+	if err != nil {
+		logger.Error("failed to get balance", zap.Int64("user_id", userData.ID), zap.Error(err))
+		return nil, grpcError(err)
+	}
+
+	return &pb.GetBalanceResponse{Current: balance.Current, Withdrawn: balance.Withdrawn}, nil
+}
+
+func (s *GRPCServer) Withdraw(ctx context.Context, req *pb.WithdrawRequest) (*pb.WithdrawResponse, error) {
+	logger := logging.FromContext(ctx, s.logger)
+
+	userData := ctx.Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	if !luhn.IsValid(req.Order) {
+		return nil, grpcError(ErrInvalidOrderNumber)
+	}
+
+	orderID, err := strconv.ParseInt(req.Order, 10, 64)
+	if err != nil {
+		return nil, grpcError(ErrInvalidOrderNumber)
+	}
+
+	if err := s.storageService.Withdraw(ctx, userData.ID, orderID, req.Sum); err != nil {
+		if !errors.Is(err, storage.ErrNotEnoughBalance) {
+			logger.Error("failed to withdraw", zap.Error(err))
+		}
+		return nil, grpcError(err)
+	}
+
+	publishWithdrawal(ctx, logger, s.storageService, s.events, userData.ID, req.Order, req.Sum)
+
+	return &pb.WithdrawResponse{}, nil
+}
+
+func (s *GRPCServer) ListWithdrawals(ctx context.Context, _ *pb.ListWithdrawalsRequest) (*pb.ListWithdrawalsResponse, error) {
+	logger := logging.FromContext(ctx, s.logger)
+
+	userData := ctx.Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	ws, err := s.storageService.GetWithdrawals(ctx, userData.ID)
+	if err != nil {
+		logger.Error("failed to get withdrawals", zap.Int64("user_id", userData.ID), zap.Error(err))
+		return nil, grpcError(err)
+	}
+
+	resp := &pb.ListWithdrawalsResponse{Withdrawals: make([]*pb.Withdrawal, len(ws))}
+	for i, e := range ws {
+		resp.Withdrawals[i] = &pb.Withdrawal{
+			Order:       strconv.FormatInt(e.Order, 10),
+			Sum:         e.Sum,
+			ProcessedAt: timestamppb.New(e.ProcessedAt),
+		}
+	}
+
+	return resp, nil
+}
+
+func (s *GRPCServer) authResponse(ctx context.Context, userID int64) (*pb.AuthResponse, error) {
+	logger := logging.FromContext(ctx, s.logger)
+
+	_, value, err := s.authorizer.Encode(map[string]interface{}{"id": userID, "ts": time.Now().Unix()})
+	if err != nil {
+		logger.Error("failed to encode JWT", zap.Error(err))
+		return nil, grpcError(err)
+	}
+
+	return &pb.AuthResponse{Token: value}, nil
+}
+
+var httpToGRPCCodes = map[int]codes.Code{
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+	http.StatusPaymentRequired:     codes.FailedPrecondition,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.AlreadyExists,
+	http.StatusUnprocessableEntity: codes.InvalidArgument,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+}
+
+// grpcError is the gRPC counterpart of writeError. The problem code
+// is passed as the reason of the ErrorInfo status detail.
+func grpcError(err error) error {
+	return grpcStatusError(err)
+}
+
+// grpcRetryError is grpcError with a RetryInfo detail, the counterpart
+// of the Retry-After header.
+func grpcRetryError(err error, retryAfter time.Duration) error {
+	return grpcStatusError(err, &errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)})
+}
+
+func grpcStatusError(err error, details ...protoiface.MessageV1) error {
+	d := describeError(err)
+
+	code, exists := httpToGRPCCodes[d.status]
+	if !exists {
+		code = codes.Internal
+	}
+
+	details = append([]protoiface.MessageV1{&errdetails.ErrorInfo{
+		Reason: string(d.code),
+		Domain: grpcErrorDomain,
+	}}, details...)
+	st, detailsErr := status.New(code, d.title).WithDetails(details...)
+	if detailsErr != nil {
+		return status.Error(code, d.title)
+	}
+	return st.Err()
+}
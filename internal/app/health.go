@@ -0,0 +1,167 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/accrual"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/logging"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+const (
+	HealthUp       = "up"
+	HealthDegraded = "degraded"
+	HealthDown     = "down"
+
+	DefaultReadinessTimeout = 5 * time.Second
+)
+
+// HealthServer answers liveness and readiness probes.
+// A degraded dependency is reported but doesn't make the service unready.
+type HealthServer struct {
+	ctx            context.Context
+	logger         *zap.Logger
+	storageService storage.AppStorage
+	updater        *accrual.Updater
+	checkTimeout   time.Duration
+}
+
+type healthCheck struct {
+	Status  string      `json:"status"`
+	Error   string      `json:"error,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+type schemaDetails struct {
+	Expected int `json:"expected"`
+	Actual   int `json:"actual"`
+}
+
+func NewHealthServer(ctx context.Context, logger *zap.Logger, storage storage.AppStorage, updater *accrual.Updater, checkTimeout time.Duration) (*HealthServer, error) {
+	if checkTimeout <= 0 {
+		checkTimeout = DefaultReadinessTimeout
+	}
+
+	server := &HealthServer{
+		ctx:            ctx,
+		logger:         logger,
+		storageService: storage,
+		updater:        updater,
+		checkTimeout:   checkTimeout,
+	}
+
+	return server, nil
+}
+
+func (s *HealthServer) apiLiveness(w http.ResponseWriter, r *http.Request) {
+	s.apiWriteResponse(w, r, http.StatusOK, healthResponse{Status: HealthUp})
+}
+
+// apiReadiness reports the checks with their errors and details,
+// it is served by the internal listener.
+func (s *HealthServer) apiReadiness(w http.ResponseWriter, r *http.Request) {
+	statusCode, resp := s.readiness(r.Context())
+	s.apiWriteResponse(w, r, statusCode, resp)
+}
+
+// apiPublicReadiness reports only the status of every check. Errors
+// and details may reveal database and accrual system addresses, they
+// are not given to anonymous clients.
+func (s *HealthServer) apiPublicReadiness(w http.ResponseWriter, r *http.Request) {
+	statusCode, resp := s.readiness(r.Context())
+	for name, c := range resp.Checks {
+		resp.Checks[name] = healthCheck{Status: c.Status}
+	}
+	s.apiWriteResponse(w, r, statusCode, resp)
+}
+
+func (s *HealthServer) readiness(ctx context.Context) (int, healthResponse) {
+	ctx, cancel := context.WithTimeout(ctx, s.checkTimeout)
+	defer cancel()
+
+	resp := healthResponse{
+		Status: HealthUp,
+		Checks: map[string]healthCheck{
+			"database": s.checkDatabase(ctx),
+			"schema":   s.checkSchema(ctx),
+			"accrual":  s.checkAccrual(),
+		},
+	}
+
+	statusCode := http.StatusOK
+	for _, c := range resp.Checks {
+		switch c.Status {
+		case HealthDown:
+			resp.Status = HealthDown
+			statusCode = http.StatusServiceUnavailable
+		case HealthDegraded:
+			if resp.Status == HealthUp {
+				resp.Status = HealthDegraded
+			}
+		}
+	}
+
+	return statusCode, resp
+}
+
+func (s *HealthServer) checkDatabase(ctx context.Context) healthCheck {
+	if err := s.storageService.Ping(ctx); err != nil {
+		return healthCheck{Status: HealthDown, Error: err.Error()}
+	}
+	return healthCheck{Status: HealthUp}
+}
+
+// checkSchema fails if another build has migrated the database
+// to a schema version this one doesn't know.
+func (s *HealthServer) checkSchema(ctx context.Context) healthCheck {
+	version, err := s.storageService.GetSchemaVersion(ctx)
+	if err != nil {
+		return healthCheck{Status: HealthDown, Error: err.Error()}
+	}
+
+	details := schemaDetails{Expected: storage.SchemaVersion, Actual: version}
+	if version != storage.SchemaVersion {
+		return healthCheck{Status: HealthDown, Error: "schema version mismatch", Details: details}
+	}
+	return healthCheck{Status: HealthUp, Details: details}
+}
+
+// checkAccrual reports a stale updater and an open circuit as degraded:
+// orders are still accepted and get processed once polling catches up.
+func (s *HealthServer) checkAccrual() healthCheck {
+	health := s.updater.Health()
+
+	switch {
+	case health.Stale:
+		return healthCheck{Status: HealthDegraded, Error: "no polling progress", Details: health}
+	case health.Breaker.State == accrual.BreakerOpen.String():
+		return healthCheck{Status: HealthDegraded, Error: accrual.ErrCircuitOpen.Error(), Details: health}
+	}
+	return healthCheck{Status: HealthUp, Details: health}
+}
+
+func (s *HealthServer) apiWriteResponse(w http.ResponseWriter, r *http.Request, statusCode int, response interface{}) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
+	dst, err := json.Marshal(response)
+	if err != nil {
+		logger.Error("failed to marshal response", zap.Error(err))
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	if _, err := w.Write(dst); err != nil {
+		logger.Error("failed to write response body", zap.Error(err))
+	}
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultLockoutDuration is used if LockoutPolicy.Duration is not set.
+const DefaultLockoutDuration = 5 * time.Minute
+
+// LockoutPolicy locks a login for Duration after MaxFailures failed
+// attempts, each within Duration of the previous one. Zero MaxFailures
+// disables the lockout.
+type LockoutPolicy struct {
+	MaxFailures int
+	Duration    time.Duration
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// loginLockout counts failed logins per login in the process memory.
+// The policy is read on every attempt, so it can be changed at runtime.
+type loginLockout struct {
+	policy func() LockoutPolicy
+
+	mu        sync.Mutex
+	failures  map[string]*loginFailures
+	lastSweep time.Time
+}
+
+func newLoginLockout(policy func() LockoutPolicy) *loginLockout {
+	return &loginLockout{
+		policy:    policy,
+		failures:  make(map[string]*loginFailures),
+		lastSweep: time.Now(),
+	}
+}
+
+// locked returns how long the login stays locked, zero if it isn't.
+func (l *loginLockout) locked(login string) time.Duration {
+	if l.policy().MaxFailures <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.failures[login]
+	if !ok {
+		return 0
+	}
+	if remaining := time.Until(f.lockedUntil); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// fail records a failed attempt and locks the login once there are too many.
+func (l *loginLockout) fail(login string) {
+	p := l.policy()
+	if p.MaxFailures <= 0 {
+		return
+	}
+	if p.Duration <= 0 {
+		p.Duration = DefaultLockoutDuration
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= p.Duration {
+		l.sweep(now, p.Duration)
+	}
+
+	f, ok := l.failures[login]
+	if !ok || now.Sub(f.last) > p.Duration {
+		f = &loginFailures{}
+		l.failures[login] = f
+	}
+	f.count++
+	f.last = now
+	if f.count >= p.MaxFailures {
+		f.count = 0
+		f.lockedUntil = now.Add(p.Duration)
+	}
+}
+
+// succeed forgets the failed attempts of the login.
+func (l *loginLockout) succeed(login string) {
+	l.mu.Lock()
+	delete(l.failures, login)
+	l.mu.Unlock()
+}
+
+// sweep drops logins which are neither locked nor failed recently.
+func (l *loginLockout) sweep(now time.Time, window time.Duration) {
+	for login, f := range l.failures {
+		if now.After(f.lockedUntil) && now.Sub(f.last) > window {
+			delete(l.failures, login)
+		}
+	}
+	l.lastSweep = now
+}
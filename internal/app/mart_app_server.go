@@ -4,54 +4,70 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/events"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/logging"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/luhn"
 	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
 	"go.uber.org/zap"
 	"io"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	maxOrdersBatchSize = 1000
+
+	batchOrderInvalid = "invalid"
+)
+
 type MartServer struct {
 	ctx            context.Context
 	logger         *zap.Logger
 	storageService storage.AppStorage
+	events         *events.Bus
 }
 
-func NewAppServer(ctx context.Context, logger *zap.Logger, storage storage.AppStorage) (*MartServer, error) {
+func NewAppServer(ctx context.Context, logger *zap.Logger, storage storage.AppStorage, bus *events.Bus) (*MartServer, error) {
 	server := &MartServer{
 		ctx:            ctx,
 		logger:         logger,
 		storageService: storage,
+		events:         bus,
 	}
 
 	return server, nil
 }
 
 func (s *MartServer) apiAddUserOrder(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
 	if contentType := r.Header.Get("Content-Type"); contentType != "text/plain" {
-		s.logger.Error("bad content type", zap.String("content_type", contentType))
-		http.Error(w, "", http.StatusBadRequest)
+		logger.Error("bad content type", zap.String("content_type", contentType))
+		writeError(w, r, ErrBadContentType)
 		return
 	}
 
 	b, err := io.ReadAll(r.Body)
 	if err != nil {
-		s.logger.Error("failed to read request body", zap.Error(err))
-		http.Error(w, "", http.StatusBadRequest)
+		logger.Error("failed to read request body", zap.Error(err))
+		writeError(w, r, fmt.Errorf("%w: %v", ErrBadRequestBody, err))
 		return
 	}
 
-	if !IsValidLuhn(string(b)) {
-		s.logger.Error("bad order id", zap.String("order_id", string(b)))
-		http.Error(w, "", http.StatusUnprocessableEntity)
+	if !luhn.IsValid(string(b)) {
+		logger.Error("bad order id", zap.String("order_id", string(b)))
+		writeError(w, r, ErrInvalidOrderNumber)
 		return
 	}
 
 	orderID, err := strconv.ParseInt(string(b), 10, 64)
 	if err != nil {
-		s.logger.Error("failed to get order id", zap.Error(err))
-		http.Error(w, "", http.StatusBadRequest)
+		logger.Error("failed to get order id", zap.Error(err))
+		writeError(w, r, ErrBadOrderNumberFormat)
 		return
 	}
 
@@ -59,30 +75,114 @@ func (s *MartServer) apiAddUserOrder(w http.ResponseWriter, r *http.Request) {
 
 	if err := s.storageService.AddOrder(r.Context(), userData.ID, orderID); err != nil {
 		if errors.Is(err, storage.ErrDuplicateOrder) {
-			s.logger.Error("duplicate order id", zap.Int64("order_id", orderID))
-			http.Error(w, "", http.StatusConflict)
+			logger.Error("duplicate order id", zap.Int64("order_id", orderID))
+			writeError(w, r, err)
 			return
 		}
 		if errors.Is(err, storage.ErrOrderAlreadyPlaced) {
-			s.logger.Info("order already placed", zap.Int64("order_id", orderID))
+			logger.Info("order already placed", zap.Int64("order_id", orderID))
 			w.WriteHeader(http.StatusOK)
 			return
 		}
-		s.logger.Error("failed to add order", zap.Error(err))
-		http.Error(w, "", http.StatusBadRequest)
+		logger.Error("failed to add order", zap.Error(err))
+		writeError(w, r, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusAccepted)
 }
 
+func (s *MartServer) apiAddUserOrdersBatch(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
+	numbers, err := s.apiParseOrdersBatch(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if len(numbers) == 0 || len(numbers) > maxOrdersBatchSize {
+		logger.Error("bad orders batch size", zap.Int("size", len(numbers)))
+		writeError(w, r, ErrBadBatchSize)
+		return
+	}
+
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	respData := make([]batchOrderResponse, len(numbers))
+	orderIDs := make([]int64, 0, len(numbers))
+	positions := make([]int, 0, len(numbers))
+	for i, number := range numbers {
+		respData[i] = batchOrderResponse{Number: number, Result: batchOrderInvalid}
+
+		orderID, err := parseOrderNumber(number)
+		if err != nil {
+			continue
+		}
+		orderIDs = append(orderIDs, orderID)
+		positions = append(positions, i)
+	}
+
+	if len(orderIDs) != 0 {
+		results, err := s.storageService.AddOrders(r.Context(), userData.ID, orderIDs)
+		if err != nil {
+			logger.Error("failed to add orders", zap.Int64("user_id", userData.ID), zap.Error(err))
+			writeError(w, r, err)
+			return
+		}
+
+		for i, res := range results {
+			respData[positions[i]].Result = res.Result
+		}
+	}
+
+	s.apiWriteResponse(w, r, http.StatusOK, respData)
+}
+
+// apiParseOrdersBatch reads order numbers from a JSON array of strings
+// or from a newline-delimited text body.
+func (s *MartServer) apiParseOrdersBatch(r *http.Request) ([]string, error) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" && contentType != "text/plain" {
+		logger.Error("bad content type", zap.String("content_type", contentType))
+		return nil, ErrBadContentType
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Error("failed to read request body", zap.Error(err))
+		return nil, fmt.Errorf("%w: %v", ErrBadRequestBody, err)
+	}
+
+	if contentType == "application/json" {
+		numbers := make([]string, 0)
+		if err := json.Unmarshal(b, &numbers); err != nil {
+			logger.Error("failed to unmarshal request json", zap.Error(err))
+			return nil, ErrBodyUnmarshal
+		}
+		return numbers, nil
+	}
+
+	numbers := make([]string, 0)
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); len(line) != 0 {
+			numbers = append(numbers, line)
+		}
+	}
+	return numbers, nil
+}
+
 func (s *MartServer) apiGetUserOrders(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
 	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
 
 	orders, err := s.storageService.GetOrders(r.Context(), userData.ID)
 	if err != nil {
-		s.logger.Error("get orders failed", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		logger.Error("get orders failed", zap.Error(err))
+		writeError(w, r, err)
 		return
 	}
 
@@ -96,16 +196,69 @@ func (s *MartServer) apiGetUserOrders(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	s.apiWriteResponse(w, http.StatusOK, respData)
+	s.apiWriteResponse(w, r, http.StatusOK, respData)
+}
+
+func (s *MartServer) apiGetUserOrder(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
+	orderID, err := strconv.ParseInt(chi.URLParam(r, "number"), 10, 64)
+	if err != nil {
+		writeError(w, r, ErrBadRouteParameter)
+		return
+	}
+
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	order, err := s.storageService.GetOrder(r.Context(), orderID)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNoSuchOrder) {
+			logger.Error("failed to get order", zap.Int64("order_id", orderID), zap.Error(err))
+		}
+		writeError(w, r, err)
+		return
+	}
+
+	if order.UserID != userData.ID {
+		writeError(w, r, ErrOrderAccessDenied)
+		return
+	}
+
+	respData := orderDetailsResponse{
+		orderResponse: orderResponse{
+			Number:     strconv.FormatInt(order.ID, 10),
+			Status:     order.Status,
+			Accrual:    order.Accrual,
+			UploadedAt: order.UploadedAt,
+		},
+		UpdatedAt: order.UpdatedAt,
+	}
+
+	withdrawal, err := s.storageService.GetWithdrawal(r.Context(), userData.ID, orderID)
+	switch {
+	case err == nil:
+		respData.Withdrawal = &orderWithdrawalResponse{
+			Sum:         withdrawal.Sum,
+			ProcessedAt: withdrawal.ProcessedAt,
+		}
+	case !errors.Is(err, storage.ErrNoSuchWithdrawal):
+		logger.Error("failed to get withdrawal", zap.Int64("order_id", orderID), zap.Error(err))
+		writeError(w, r, err)
+		return
+	}
+
+	s.apiWriteResponse(w, r, http.StatusOK, respData)
 }
 
 func (s *MartServer) apiGetUserWithdrawals(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
 	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
 
 	ws, err := s.storageService.GetWithdrawals(r.Context(), userData.ID)
 	if err != nil {
-		s.logger.Error("failed to get withdrawals", zap.Int64("user_id", userData.ID), zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		logger.Error("failed to get withdrawals", zap.Int64("user_id", userData.ID), zap.Error(err))
+		writeError(w, r, err)
 		return
 	}
 
@@ -123,83 +276,134 @@ func (s *MartServer) apiGetUserWithdrawals(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	s.apiWriteResponse(w, http.StatusOK, responseData)
+	s.apiWriteResponse(w, r, http.StatusOK, responseData)
 }
 
 func (s *MartServer) apiGetUserBalance(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
 	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
 
 	balance, err := s.storageService.GetBalance(r.Context(), userData.ID)
 	if err != nil {
-		s.logger.Error("failed to get balance", zap.Int64("user_id", userData.ID), zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		logger.Error("failed to get balance", zap.Int64("user_id", userData.ID), zap.Error(err))
+		writeError(w, r, err)
 		return
 	}
 
-	s.apiWriteResponse(w, http.StatusOK, balance)
+	s.apiWriteResponse(w, r, http.StatusOK, balance)
 }
 
 func (s *MartServer) apiBalanceWithdraw(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
 	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
 
 	withdrawRequest := balanceWithdrawRequest{}
 	if err := s.apiParseRequest(r, &withdrawRequest); err != nil {
-		s.logger.Error("failed to withdraw balance", zap.Int64("user_id", userData.ID), zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		logger.Error("failed to withdraw balance", zap.Int64("user_id", userData.ID), zap.Error(err))
+		writeError(w, r, err)
 		return
 	}
 
-	if !IsValidLuhn(withdrawRequest.Order) {
-		s.logger.Error("bad order id", zap.String("order_id", withdrawRequest.Order))
-		http.Error(w, "", http.StatusUnprocessableEntity)
+	if !luhn.IsValid(withdrawRequest.Order) {
+		logger.Error("bad order id", zap.String("order_id", withdrawRequest.Order))
+		writeError(w, r, ErrInvalidOrderNumber)
 		return
 	}
 
 	orderID, err := strconv.ParseInt(withdrawRequest.Order, 10, 64)
 	if err != nil {
-		s.logger.Error("bad order id", zap.String("order_id", withdrawRequest.Order))
-		http.Error(w, "", http.StatusUnprocessableEntity)
+		logger.Error("bad order id", zap.String("order_id", withdrawRequest.Order))
+		writeError(w, r, ErrInvalidOrderNumber)
 		return
 	}
 
 	err = s.storageService.Withdraw(r.Context(), userData.ID, orderID, withdrawRequest.Sum)
 	if err != nil {
-		if err == storage.ErrNotEnoughBalance {
-			http.Error(w, "", http.StatusPaymentRequired)
-			return
+		if !errors.Is(err, storage.ErrNotEnoughBalance) {
+			logger.Error("failed to withdraw", zap.Error(err))
 		}
-		s.logger.Error("failed to withdraw", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
+
+	publishWithdrawal(r.Context(), logger, s.storageService, s.events, userData.ID, withdrawRequest.Order, withdrawRequest.Sum)
+}
+
+// publishWithdrawal publishes a completed withdrawal and the balance after
+// it, it is shared by the HTTP and gRPC APIs. The bus may be nil.
+func publishWithdrawal(ctx context.Context, logger *zap.Logger, st storage.AppStorage, bus *events.Bus, userID int64, order string, sum float64) {
+	if bus == nil {
+		return
+	}
+
+	bus.Publish(userID, events.TypeWithdrawalCompleted, events.Withdrawal{
+		Order:       order,
+		Sum:         sum,
+		ProcessedAt: time.Now(),
+	})
+	publishBalance(ctx, logger, st, bus, userID)
+}
+
+// publishOrderStatus publishes the current status of the order like
+// the accrual updater does. The bus may be nil.
+func publishOrderStatus(bus *events.Bus, order storage.Order) {
+	if bus == nil {
+		return
+	}
+
+	bus.Publish(order.UserID, events.TypeOrderStatusChanged, events.OrderStatus{
+		Number:  strconv.FormatInt(order.ID, 10),
+		Status:  order.Status,
+		Accrual: order.Accrual,
+	})
+}
+
+// publishBalance publishes the current balance of the user. The bus may be nil.
+func publishBalance(ctx context.Context, logger *zap.Logger, st storage.AppStorage, bus *events.Bus, userID int64) {
+	if bus == nil {
+		return
+	}
+
+	balance, err := st.GetBalance(ctx, userID)
+	if err != nil {
+		logger.Error("failed to get balance for event", zap.Int64("user_id", userID), zap.Error(err))
+		return
+	}
+	bus.Publish(userID, events.TypeBalanceChanged, balance)
 }
 
 func (s *MartServer) apiParseRequest(r *http.Request, body interface{}) error {
+	logger := logging.FromContext(r.Context(), s.logger)
+
 	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
-		s.logger.Error("bad content type", zap.String("content_type", contentType))
+		logger.Error("bad content type", zap.String("content_type", contentType))
 		return ErrBadContentType
 	}
 
 	b, err := io.ReadAll(r.Body)
 	if err != nil {
-		s.logger.Error("failed to read request body", zap.Error(err))
-		return err
+		logger.Error("failed to read request body", zap.Error(err))
+		return fmt.Errorf("%w: %v", ErrBadRequestBody, err)
 	}
 
 	if err = json.Unmarshal(b, &body); err != nil {
-		s.logger.Error("failed to unmarshal request json", zap.Error(err))
+		logger.Error("failed to unmarshal request json", zap.Error(err))
 		return ErrBodyUnmarshal
 	}
 
 	return nil
 }
 
-func (s *MartServer) apiWriteResponse(w http.ResponseWriter, statusCode int, response interface{}) {
+func (s *MartServer) apiWriteResponse(w http.ResponseWriter, r *http.Request, statusCode int, response interface{}) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
 	dst, err := json.Marshal(response)
 	if err != nil {
-		s.logger.Error("failed to marshal response", zap.Error(err))
-		http.Error(w, "", http.StatusInternalServerError)
+		logger.Error("failed to marshal response", zap.Error(err))
+		writeError(w, r, err)
 		return
 	}
 
@@ -207,8 +411,34 @@ func (s *MartServer) apiWriteResponse(w http.ResponseWriter, statusCode int, res
 	w.WriteHeader(statusCode)
 
 	if _, err := w.Write(dst); err != nil {
-		s.logger.Error("failed to write response body", zap.Error(err))
+		logger.Error("failed to write response body", zap.Error(err))
+	}
+}
+
+// parseOrderNumber checks that the number consists of digits only
+// and passes the Luhn check.
+func parseOrderNumber(number string) (int64, error) {
+	for _, c := range number {
+		if c < '0' || c > '9' {
+			return 0, ErrBadOrderNumberFormat
+		}
+	}
+
+	if !luhn.IsValid(number) {
+		return 0, ErrInvalidOrderNumber
+	}
+
+	orderID, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, ErrBadOrderNumberFormat
 	}
+
+	return orderID, nil
+}
+
+type batchOrderResponse struct {
+	Number string `json:"number"`
+	Result string `json:"result"`
 }
 
 type orderResponse struct {
@@ -218,6 +448,17 @@ type orderResponse struct {
 	UploadedAt time.Time `json:"uploaded_at"`
 }
 
+type orderDetailsResponse struct {
+	orderResponse
+	UpdatedAt  time.Time                `json:"updated_at"`
+	Withdrawal *orderWithdrawalResponse `json:"withdrawal,omitempty"`
+}
+
+type orderWithdrawalResponse struct {
+	Sum         float64   `json:"sum"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
 type withdrawalsResponse struct {
 	Order       string    `json:"order"`
 	Sum         float64   `json:"sum"`
@@ -3,11 +3,22 @@ package app
 import (
 	"compress/gzip"
 	"context"
+	"crypto/subtle"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/jwtauth"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/metrics"
 	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
+	"strings"
+	"time"
 )
 
+const bearerPrefix = "Bearer "
+
 var UserAuthDataCtxKey = &contextKey{"UserAuthData"}
 
 type gzipBodyReader struct {
@@ -27,7 +38,7 @@ func DecompressGzip(next http.Handler) http.Handler {
 		if r.Header.Get("Content-Encoding") == "gzip" {
 			gz, err := gzip.NewReader(r.Body)
 			if err != nil {
-				http.Error(w, "", http.StatusInternalServerError)
+				writeError(w, r, fmt.Errorf("%w: %v", ErrBadContentEncoding, err))
 				return
 			}
 			r.Body = &gzipBodyReader{gzipReader: gz}
@@ -36,44 +47,165 @@ func DecompressGzip(next http.Handler) http.Handler {
 	})
 }
 
+// AuthorizationVerifier replaces jwtauth.Authenticator after jwtauth.Verifier:
+// a missing, unverified or expired token is rejected the same way, but with
+// a problem+json 401 like the other errors. The user of a valid token must
+// exist and be active.
 func AuthorizationVerifier(st storage.AppStorage) func(handler http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		authFn := func(w http.ResponseWriter, r *http.Request) {
 			ctx := r.Context()
-			_, claims, err := jwtauth.FromContext(ctx)
+			token, claims, err := jwtauth.FromContext(ctx)
+			if err != nil || token == nil {
+				writeError(w, r, ErrUnauthorized)
+				return
+			}
+			userData, err := authorizeUser(ctx, st, claims)
 			if err != nil {
-				http.Error(w, "", http.StatusUnauthorized)
+				writeError(w, r, err)
 				return
 			}
-			userID := int64(0)
-			if id, exists := claims["id"]; exists {
-				switch value := id.(type) {
-				case int:
-					userID = int64(value)
-				case int64:
-					userID = value
-				case float64:
-					userID = int64(value)
-				default:
-					http.Error(w, "", http.StatusUnauthorized)
-					return
-				}
+
+			ctx = context.WithValue(ctx, UserAuthDataCtxKey, userData)
+			ctx = withRequestUser(ctx, userData.ID)
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(authFn)
+	}
+}
+
+// authorizeUser returns the active user the token claims belong to.
+func authorizeUser(ctx context.Context, st storage.AppStorage, claims map[string]interface{}) (*storage.UserAuthorization, error) {
+	userID := int64(0)
+	if id, exists := claims["id"]; exists {
+		switch value := id.(type) {
+		case int:
+			userID = int64(value)
+		case int64:
+			userID = value
+		case float64:
+			userID = int64(value)
+		default:
+			return nil, ErrJWTKeyBadFormat
+		}
+	}
+
+	userData, err := st.GetUserAuthInfoByID(ctx, userID)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+
+	if userData.State != storage.UserStateActive {
+		return nil, ErrUnauthorized
+	}
+
+	return userData, nil
+}
+
+// ConditionalGET replaces middleware.NoCache for user data listings.
+// Responses are tagged with the user data version and the client
+// revalidates them with If-None-Match on every request.
+// It must be used after AuthorizationVerifier.
+func ConditionalGET(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+		etag := fmt.Sprintf(`"%d-%d"`, userData.ID, userData.DataVersion)
+
+		w.Header().Set("Cache-Control", "private, no-cache")
+		w.Header().Set("ETag", etag)
+
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		next.ServeHTTP(&etagResponseWriter{ResponseWriter: w}, r)
+	})
+}
+
+// etagResponseWriter drops the ETag from error responses.
+type etagResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *etagResponseWriter) WriteHeader(statusCode int) {
+	if statusCode != http.StatusOK && statusCode != http.StatusNoContent {
+		w.Header().Del("ETag")
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, value := range strings.Split(ifNoneMatch, ",") {
+		value = strings.TrimPrefix(strings.TrimSpace(value), "W/")
+		if value == etag || value == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// TraceRoute names the request span after the matched route pattern,
+// the pattern is known only once the request is routed.
+func TraceRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		rctx := chi.RouteContext(r.Context())
+		if rctx == nil || len(rctx.RoutePattern()) == 0 {
+			return
+		}
+
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(r.Method + " " + rctx.RoutePattern())
+		span.SetAttributes(semconv.HTTPRouteKey.String(rctx.RoutePattern()))
+	})
+}
+
+// RequestMetrics counts requests by the matched route pattern,
+// so path parameters don't multiply the series.
+func RequestMetrics(m *metrics.Metrics) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			next.ServeHTTP(ww, r)
+
+			route := "unmatched"
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && len(rctx.RoutePattern()) != 0 {
+				route = rctx.RoutePattern()
+			}
+
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
 			}
 
-			userData, err := st.GetUserAuthInfoByID(ctx, userID)
-			if err != nil {
-				http.Error(w, "", http.StatusUnauthorized)
+			m.ObserveHTTPRequest(route, r.Method, status, time.Since(start))
+		})
+	}
+}
+
+// AdminAuthorization lets through requests carrying the operator token
+// in the "Authorization: Bearer <token>" header.
+func AdminAuthorization(token string) func(handler http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authFn := func(w http.ResponseWriter, r *http.Request) {
+			value := r.Header.Get("Authorization")
+			if !strings.HasPrefix(value, bearerPrefix) {
+				writeError(w, r, ErrUnauthorized)
 				return
 			}
 
-			if userData.State != storage.UserStateActive {
-				http.Error(w, "", http.StatusUnauthorized)
+			provided := []byte(strings.TrimPrefix(value, bearerPrefix))
+			if subtle.ConstantTimeCompare(provided, []byte(token)) != 1 {
+				writeError(w, r, ErrUnauthorized)
 				return
 			}
 
-			ctx = context.WithValue(ctx, UserAuthDataCtxKey, userData)
-
-			next.ServeHTTP(w, r.WithContext(ctx))
+			next.ServeHTTP(w, r)
 		}
 		return http.HandlerFunc(authFn)
 	}
@@ -0,0 +1,397 @@
+package app
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+const (
+	schemaRefPrefix = "#/components/schemas/"
+
+	// MaxValidatedBodySize bounds the bodies read by RequestValidator,
+	// a batch of 1000 orders is far below it.
+	MaxValidatedBodySize = 1 << 20
+)
+
+// OpenAPISpec is the subset of the OpenAPI document used to check
+// that every route is documented and to validate request bodies.
+type OpenAPISpec struct {
+	// publicDocument is served by the public listener, it leaves out
+	// the operational routes.
+	publicDocument []byte
+
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas map[string]*jsonSchema `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *jsonSchema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+// jsonSchema supports the part of JSON Schema used in openapi.json.
+type jsonSchema struct {
+	Ref              string                 `json:"$ref"`
+	Type             string                 `json:"type"`
+	Required         []string               `json:"required"`
+	Properties       map[string]*jsonSchema `json:"properties"`
+	Items            *jsonSchema            `json:"items"`
+	Enum             []interface{}          `json:"enum"`
+	Pattern          string                 `json:"pattern"`
+	MinLength        *int                   `json:"minLength"`
+	Minimum          *float64               `json:"minimum"`
+	ExclusiveMinimum bool                   `json:"exclusiveMinimum"`
+
+	pattern *regexp.Regexp
+}
+
+func LoadOpenAPISpec() (*OpenAPISpec, error) {
+	spec := &OpenAPISpec{}
+	if err := json.Unmarshal(openAPIDocument, spec); err != nil {
+		return nil, err
+	}
+
+	for _, s := range spec.Components.Schemas {
+		if err := s.compile(); err != nil {
+			return nil, err
+		}
+	}
+	for _, item := range spec.Paths {
+		for _, op := range item {
+			if op.RequestBody == nil {
+				continue
+			}
+			for _, media := range op.RequestBody.Content {
+				if err := media.Schema.compile(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	public, err := publicOpenAPIDocument(openAPIDocument)
+	if err != nil {
+		return nil, err
+	}
+	spec.publicDocument = public
+
+	return spec, nil
+}
+
+// isOperationalRoute tells if the route is served by the internal listener
+// when it is configured. Such routes are left out of the public document.
+func isOperationalRoute(route string) bool {
+	return route == "/metrics" || strings.HasPrefix(route, "/internal/")
+}
+
+// publicOpenAPIDocument removes the operational routes from the document
+// along with the components only they refer to.
+func publicOpenAPIDocument(document []byte) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(document, &doc); err != nil {
+		return nil, err
+	}
+
+	paths, _ := doc["paths"].(map[string]interface{})
+	for route := range paths {
+		if isOperationalRoute(route) {
+			delete(paths, route)
+		}
+	}
+
+	components, _ := doc["components"].(map[string]interface{})
+	for removed := true; removed; {
+		refs := make(map[string]bool)
+		collectRefs(doc, refs)
+
+		removed = false
+		for kind, c := range components {
+			entries, _ := c.(map[string]interface{})
+			for name := range entries {
+				if !refs["#/components/"+kind+"/"+name] {
+					delete(entries, name)
+					removed = true
+				}
+			}
+		}
+	}
+
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// collectRefs collects the component references of the value including
+// the security schemes named in security requirements.
+func collectRefs(value interface{}, refs map[string]bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if ref, ok := item.(string); ok && key == "$ref" {
+				refs[ref] = true
+				continue
+			}
+			if requirements, ok := item.([]interface{}); ok && key == "security" {
+				for _, r := range requirements {
+					schemes, _ := r.(map[string]interface{})
+					for name := range schemes {
+						refs["#/components/securitySchemes/"+name] = true
+					}
+				}
+				continue
+			}
+			collectRefs(item, refs)
+		}
+	case []interface{}:
+		for _, item := range v {
+			collectRefs(item, refs)
+		}
+	}
+}
+
+// CheckRoutes returns an error listing every route registered in the router
+// which is missing from the document.
+func (s *OpenAPISpec) CheckRoutes(routes chi.Routes) error {
+	missing := make([]string, 0)
+	err := chi.Walk(routes, func(method string, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		route = normalizeRoute(route)
+		if _, exists := s.Paths[route][strings.ToLower(method)]; !exists {
+			missing = append(missing, method+" "+route)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("routes missing from OpenAPI document: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (s *OpenAPISpec) findOperation(method, path string) *openAPIOperation {
+	path = normalizeRoute(path)
+	if item, exists := s.Paths[path]; exists {
+		return item[strings.ToLower(method)]
+	}
+	for template, item := range s.Paths {
+		if matchPathTemplate(template, path) {
+			return item[strings.ToLower(method)]
+		}
+	}
+	return nil
+}
+
+// RequestValidator rejects requests whose bodies don't match the
+// request body schema of the corresponding operation. Bodies larger
+// than MaxValidatedBodySize are rejected without being read further.
+func RequestValidator(spec *OpenAPISpec) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			op := spec.findOperation(r.Method, r.URL.Path)
+			if op == nil || op.RequestBody == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil {
+				writeError(w, r, ErrBadContentType)
+				return
+			}
+
+			media, exists := op.RequestBody.Content[contentType]
+			if !exists {
+				writeError(w, r, ErrBadContentType)
+				return
+			}
+
+			b, err := io.ReadAll(io.LimitReader(r.Body, MaxValidatedBodySize+1))
+			if err != nil {
+				writeError(w, r, fmt.Errorf("%w: %v", ErrBadRequestBody, err))
+				return
+			}
+			if len(b) > MaxValidatedBodySize {
+				writeError(w, r, ErrRequestBodyTooLarge)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(b))
+
+			var value interface{} = string(b)
+			if contentType == "application/json" {
+				if err := json.Unmarshal(b, &value); err != nil {
+					writeError(w, r, ErrBodyUnmarshal)
+					return
+				}
+			}
+
+			if err := spec.validate(media.Schema, value, "body"); err != nil {
+				writeError(w, r, err)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (s *OpenAPISpec) apiGetDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(s.publicDocument)
+}
+
+// apiGetInternalDocument serves the whole document including
+// the operational routes.
+func (s *OpenAPISpec) apiGetInternalDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(openAPIDocument)
+}
+
+func (s *OpenAPISpec) validate(schema *jsonSchema, value interface{}, location string) error {
+	if len(schema.Ref) != 0 {
+		ref, exists := s.Components.Schemas[strings.TrimPrefix(schema.Ref, schemaRefPrefix)]
+		if !exists {
+			return fmt.Errorf("unknown schema reference %s", schema.Ref)
+		}
+		return s.validate(ref, value, location)
+	}
+
+	violation := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s %s", ErrSchemaViolation, location, fmt.Sprintf(format, args...))
+	}
+
+	switch schema.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return violation("must be an object")
+		}
+		for _, name := range schema.Required {
+			if _, exists := obj[name]; !exists {
+				return violation("misses required property %q", name)
+			}
+		}
+		for name, property := range schema.Properties {
+			if v, exists := obj[name]; exists {
+				if err := s.validate(property, v, location+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return violation("must be an array")
+		}
+		for i, v := range arr {
+			if err := s.validate(schema.Items, v, fmt.Sprintf("%s[%d]", location, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return violation("must be a string")
+		}
+		if schema.MinLength != nil && len(str) < *schema.MinLength {
+			return violation("must be at least %d characters long", *schema.MinLength)
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(str) {
+			return violation("must match %s", schema.Pattern)
+		}
+	case "number", "integer":
+		num, ok := value.(float64)
+		if !ok || (schema.Type == "integer" && num != float64(int64(num))) {
+			return violation("must be %s", schema.Type)
+		}
+		if schema.Minimum != nil {
+			if num < *schema.Minimum || (schema.ExclusiveMinimum && num == *schema.Minimum) {
+				return violation("is below the minimum")
+			}
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return violation("must be a boolean")
+		}
+	}
+
+	if len(schema.Enum) != 0 {
+		for _, e := range schema.Enum {
+			if e == value {
+				return nil
+			}
+		}
+		return violation("has unexpected value")
+	}
+
+	return nil
+}
+
+func (s *jsonSchema) compile() error {
+	if s == nil {
+		return nil
+	}
+
+	if len(s.Pattern) != 0 {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return err
+		}
+		s.pattern = re
+	}
+
+	for _, p := range s.Properties {
+		if err := p.compile(); err != nil {
+			return err
+		}
+	}
+	return s.Items.compile()
+}
+
+func normalizeRoute(route string) string {
+	if len(route) > 1 {
+		return strings.TrimSuffix(route, "/")
+	}
+	return route
+}
+
+func matchPathTemplate(template, path string) bool {
+	templateParts := strings.Split(template, "/")
+	pathParts := strings.Split(path, "/")
+	if len(templateParts) != len(pathParts) {
+		return false
+	}
+
+	for i, part := range templateParts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			if len(pathParts[i]) == 0 {
+				return false
+			}
+			continue
+		}
+		if part != pathParts[i] {
+			return false
+		}
+	}
+	return true
+}
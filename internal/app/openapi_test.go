@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/accrual"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/events"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/metrics"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// idleStorage lets the accrual updater run without a database.
+type idleStorage struct {
+	storage.AppStorage
+}
+
+func (idleStorage) GetUnfinishedOrders(context.Context) ([]storage.Order, error) {
+	return nil, nil
+}
+
+func newTestServer(t *testing.T, cfg ServerConfig) *Server {
+	t.Helper()
+
+	logger := zap.NewNop()
+	st := idleStorage{}
+	updater := accrual.NewUpdater(context.Background(), accrual.Config{
+		BaseAddr:       "http://localhost",
+		CallbackSecret: []byte("secret"),
+		Logger:         logger,
+		AppStorage:     st,
+	})
+	t.Cleanup(func() {
+		_, _ = updater.Stop(context.Background())
+	})
+
+	s, err := NewServer(context.Background(), cfg, logger, st, updater, events.NewBus(events.Config{}), metrics.New())
+	if err != nil {
+		t.Fatalf("failed to build server: %v", err)
+	}
+	return s
+}
+
+// withoutProfiles leaves out the pprof handlers, they are not a part of the API.
+func withoutProfiles(t *testing.T, routes chi.Routes) chi.Routes {
+	t.Helper()
+
+	r := chi.NewRouter()
+	err := chi.Walk(routes, func(method string, route string, h http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if !strings.HasPrefix(route, "/debug/") {
+			r.Method(method, route, h)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to walk routes: %v", err)
+	}
+	return r
+}
+
+func TestRoutesAreDocumented(t *testing.T) {
+	spec, err := LoadOpenAPISpec()
+	if err != nil {
+		t.Fatalf("failed to load OpenAPI document: %v", err)
+	}
+
+	public := &OpenAPISpec{}
+	if err := json.Unmarshal(spec.publicDocument, public); err != nil {
+		t.Fatalf("failed to parse public OpenAPI document: %v", err)
+	}
+	for route := range public.Paths {
+		if isOperationalRoute(route) {
+			t.Errorf("operational route %s is in the public OpenAPI document", route)
+		}
+	}
+
+	tests := []struct {
+		name string
+		cfg  ServerConfig
+		// public is the document describing the public listener.
+		public *OpenAPISpec
+	}{
+		{
+			name:   "internal listener",
+			cfg:    ServerConfig{Address: ":0", InternalAddress: ":0", AdminToken: "token"},
+			public: public,
+		},
+		{
+			name:   "single listener",
+			cfg:    ServerConfig{Address: ":0", AdminToken: "token"},
+			public: spec,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, tt.cfg)
+
+			if err := tt.public.CheckRoutes(s.routes); err != nil {
+				t.Error(err)
+			}
+			if s.internalRoutes != nil {
+				if err := spec.CheckRoutes(withoutProfiles(t, s.internalRoutes)); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/events"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"net/http"
+)
+
+const (
+	ProblemContentType = "application/problem+json"
+
+	problemTypePrefix = "urn:gophermart:problem:"
+)
+
+// ErrorCode is a stable machine-readable error identifier.
+// Codes are never renamed, clients may rely on them.
+type ErrorCode string
+
+const (
+	CodeBadContentType      ErrorCode = "bad_content_type"
+	CodeBadRequestBody      ErrorCode = "bad_request_body"
+	CodeBadRequest          ErrorCode = "bad_request"
+	CodeSchemaViolation     ErrorCode = "schema_violation"
+	CodeBadBatchSize        ErrorCode = "bad_batch_size"
+	CodeInvalidOrderNumber  ErrorCode = "invalid_order_number"
+	CodeInvalidCredentials  ErrorCode = "invalid_credentials"
+	CodeUnauthorized        ErrorCode = "unauthorized"
+	CodeForbidden           ErrorCode = "forbidden"
+	CodeUserExists          ErrorCode = "user_exists"
+	CodeOrderOfAnotherUser  ErrorCode = "order_of_another_user"
+	CodeOrderNotFound       ErrorCode = "order_not_found"
+	CodeOrderFinalized      ErrorCode = "order_finalized"
+	CodeNotEnoughBalance    ErrorCode = "not_enough_balance"
+	CodeMissingReason       ErrorCode = "missing_reason"
+	CodeBadAccrual          ErrorCode = "bad_accrual"
+	CodeRouteNotFound       ErrorCode = "route_not_found"
+	CodeMethodNotAllowed    ErrorCode = "method_not_allowed"
+	CodeTooManyConnections  ErrorCode = "too_many_connections"
+	CodeRateLimited         ErrorCode = "rate_limited"
+	CodeLoginLocked         ErrorCode = "login_locked"
+	CodeInternalServerError ErrorCode = "internal_error"
+	CodeBadContentEncoding  ErrorCode = "bad_content_encoding"
+	CodeRequestBodyTooLarge ErrorCode = "request_body_too_large"
+	CodeClientCertRequired  ErrorCode = "client_certificate_required"
+)
+
+// Problem is an RFC 7807 problem details object.
+type Problem struct {
+	Type     string    `json:"type"`
+	Title    string    `json:"title"`
+	Status   int       `json:"status"`
+	Detail   string    `json:"detail,omitempty"`
+	Instance string    `json:"instance,omitempty"`
+	Code     ErrorCode `json:"code"`
+}
+
+type errorDescription struct {
+	err    error
+	code   ErrorCode
+	status int
+	title  string
+}
+
+// errorCatalogue maps errors returned to handlers onto problem codes.
+// Errors are matched with errors.Is in order, the first match wins.
+// Unknown errors are reported as CodeInternalServerError without details.
+var errorCatalogue = []errorDescription{
+	{ErrBadContentType, CodeBadContentType, http.StatusBadRequest, "Unsupported request content type"},
+	{ErrBodyUnmarshal, CodeBadRequestBody, http.StatusBadRequest, "Request body is not valid JSON"},
+	{ErrBadRequestBody, CodeBadRequestBody, http.StatusBadRequest, "Request body can't be read"},
+	{ErrBadContentEncoding, CodeBadContentEncoding, http.StatusBadRequest, "Request body can't be decompressed"},
+	{ErrRequestBodyTooLarge, CodeRequestBodyTooLarge, http.StatusRequestEntityTooLarge, "Request body is too large"},
+	{ErrBadOrderNumberFormat, CodeBadRequest, http.StatusBadRequest, "Order number must be a decimal number"},
+	{ErrBadRouteParameter, CodeBadRequest, http.StatusBadRequest, "Bad route parameter"},
+	{ErrSchemaViolation, CodeSchemaViolation, http.StatusBadRequest, "Request does not match API schema"},
+	{ErrBadBatchSize, CodeBadBatchSize, http.StatusBadRequest, "Bad number of orders in batch"},
+	{ErrBadLastEventID, CodeBadRequest, http.StatusBadRequest, "Bad Last-Event-ID header"},
+	{ErrUnknownEventType, CodeBadRequest, http.StatusBadRequest, "Unknown event type"},
+	{ErrBadExportFormat, CodeBadRequest, http.StatusBadRequest, "Unsupported export format"},
+	{ErrBadExportRange, CodeBadRequest, http.StatusBadRequest, "Bad export date range"},
+	{ErrInvalidOrderNumber, CodeInvalidOrderNumber, http.StatusUnprocessableEntity, "Order number failed Luhn check"},
+	{ErrMissingReason, CodeMissingReason, http.StatusBadRequest, "Reason is required"},
+	{ErrBadAccrual, CodeBadAccrual, http.StatusBadRequest, "Accrual must be positive"},
+	{ErrInvalidCredentials, CodeInvalidCredentials, http.StatusUnauthorized, "Invalid login or password"},
+	{storage.ErrNoSuchUser, CodeInvalidCredentials, http.StatusUnauthorized, "Invalid login or password"},
+	{ErrUnauthorized, CodeUnauthorized, http.StatusUnauthorized, "Authentication required"},
+	{ErrClientCertRequired, CodeClientCertRequired, http.StatusForbidden, "Client certificate required"},
+	{ErrMissedJWTKey, CodeUnauthorized, http.StatusUnauthorized, "Authentication required"},
+	{ErrJWTKeyBadFormat, CodeUnauthorized, http.StatusUnauthorized, "Authentication required"},
+	{ErrOrderAccessDenied, CodeForbidden, http.StatusForbidden, "Order belongs to another user"},
+	{storage.ErrDuplicateUser, CodeUserExists, http.StatusConflict, "Login is already taken"},
+	{storage.ErrDuplicateOrder, CodeOrderOfAnotherUser, http.StatusConflict, "Order was uploaded by another user"},
+	{storage.ErrNoSuchOrder, CodeOrderNotFound, http.StatusNotFound, "Order not found"},
+	{storage.ErrOrderFinalized, CodeOrderFinalized, http.StatusConflict, "Order is already in a final state"},
+	{storage.ErrNotEnoughBalance, CodeNotEnoughBalance, http.StatusPaymentRequired, "Not enough points on balance"},
+	{events.ErrTooManySubscriptions, CodeTooManyConnections, http.StatusTooManyRequests, "Too many open event streams"},
+	{ErrRateLimited, CodeRateLimited, http.StatusTooManyRequests, "Too many requests"},
+	{ErrLoginLocked, CodeLoginLocked, http.StatusTooManyRequests, "Too many failed login attempts"},
+	{ErrRouteNotFound, CodeRouteNotFound, http.StatusNotFound, "Route not found"},
+	{ErrMethodNotAllowed, CodeMethodNotAllowed, http.StatusBadRequest, "Method not allowed"},
+}
+
+var internalErrorDescription = errorDescription{
+	code:   CodeInternalServerError,
+	status: http.StatusInternalServerError,
+	title:  "Internal server error",
+}
+
+func describeError(err error) errorDescription {
+	for _, d := range errorCatalogue {
+		if errors.Is(err, d.err) {
+			return d
+		}
+	}
+	return internalErrorDescription
+}
+
+// NewProblem builds problem details for the error.
+func NewProblem(r *http.Request, err error) Problem {
+	d := describeError(err)
+
+	p := Problem{
+		Type:   problemTypePrefix + string(d.code),
+		Title:  d.title,
+		Status: d.status,
+		Code:   d.code,
+	}
+	if d.code != CodeInternalServerError {
+		p.Detail = err.Error()
+	}
+	if r != nil {
+		p.Instance = r.URL.Path
+	}
+
+	return p
+}
+
+// writeError is the single place where handler errors are turned into responses.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	writeProblem(w, NewProblem(r, err))
+}
+
+func writeProblem(w http.ResponseWriter, p Problem) {
+	dst, err := json.Marshal(p)
+	if err != nil {
+		http.Error(w, "", p.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", ProblemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	_, _ = w.Write(dst)
+}
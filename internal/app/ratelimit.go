@@ -0,0 +1,220 @@
+package app
+
+import (
+	"context"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/logging"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/ratelimit"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	RateLimitLimitHeader     = "RateLimit-Limit"
+	RateLimitRemainingHeader = "RateLimit-Remaining"
+	RateLimitResetHeader     = "RateLimit-Reset"
+	RateLimitPolicyHeader    = "RateLimit-Policy"
+)
+
+// Default policies: a client may retry its password ten times, then once
+// in 5 seconds, a user may upload an order per second in bursts of 20.
+var (
+	DefaultLoginRateLimit    = ratelimit.Policy{Rate: 0.2, Burst: 10}
+	DefaultUserRateLimit     = ratelimit.Policy{Rate: 10, Burst: 50}
+	DefaultOrdersRateLimit   = ratelimit.Policy{Rate: 1, Burst: 20}
+	DefaultWithdrawRateLimit = ratelimit.Policy{Rate: 0.2, Burst: 5}
+)
+
+// RateLimitConfig limits requests per client with token buckets.
+// Requests are not limited if Store is nil, a policy is disabled
+// if its rate or burst is not positive.
+type RateLimitConfig struct {
+	Store ratelimit.Store
+	// TrustedProxies are the addresses of reverse proxies whose
+	// X-Forwarded-For header is trusted to find the client IP.
+	TrustedProxies []netip.Prefix
+
+	// Login limits registration and login attempts per client IP.
+	Login ratelimit.Policy
+	// User limits all requests of an authenticated user.
+	User ratelimit.Policy
+	// Orders additionally limits order uploads of a user.
+	Orders ratelimit.Policy
+	// Withdraw additionally limits withdrawals of a user.
+	Withdraw ratelimit.Policy
+}
+
+// ParseTrustedProxies parses IP addresses and CIDR prefixes.
+func ParseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, p := range proxies {
+		if strings.Contains(p, "/") {
+			prefix, err := netip.ParsePrefix(p)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(p)
+		if err != nil {
+			return nil, err
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// limiter takes tokens from the buckets of a named policy. Store errors
+// are logged and the request is let through, the limits must not make
+// the service unavailable.
+type limiter struct {
+	store  ratelimit.Store
+	name   string
+	policy ratelimit.Policy
+	logger *zap.Logger
+}
+
+// newLimiter returns nil if requests are not limited.
+func newLimiter(store ratelimit.Store, name string, p ratelimit.Policy, logger *zap.Logger) *limiter {
+	if store == nil || !p.Enabled() {
+		return nil
+	}
+	return &limiter{store: store, name: name, policy: p, logger: logger}
+}
+
+// take returns false if the bucket of the key could not be checked.
+func (l *limiter) take(ctx context.Context, key string) (ratelimit.Result, bool) {
+	result, err := l.store.Take(ctx, l.name+":"+key, l.policy)
+	if err != nil {
+		logging.FromContext(ctx, l.logger).Error("Failed to check rate limit",
+			zap.String("policy", l.name), zap.Error(err))
+		return ratelimit.Result{}, false
+	}
+	return result, true
+}
+
+// headers are the RateLimit-* header values of the result.
+func (l *limiter) headers(result ratelimit.Result) [][2]string {
+	return [][2]string{
+		{RateLimitLimitHeader, strconv.Itoa(result.Limit)},
+		{RateLimitRemainingHeader, strconv.Itoa(result.Remaining)},
+		{RateLimitResetHeader, strconv.Itoa(ceilSeconds(result.Reset))},
+		{RateLimitPolicyHeader, strconv.Itoa(l.policy.Burst) + ";w=" + strconv.Itoa(ceilSeconds(l.policy.Window()))},
+	}
+}
+
+// RateLimit takes a token from the bucket of the policy named name and the
+// key of the request. Requests with an empty key are not limited.
+func RateLimit(store ratelimit.Store, name string, p ratelimit.Policy, key func(r *http.Request) string, logger *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		l := newLimiter(store, name, p, logger)
+		if l == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			k := key(r)
+			if len(k) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			result, ok := l.take(r.Context(), k)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			h := w.Header()
+			for _, header := range l.headers(result) {
+				h.Set(header[0], header[1])
+			}
+
+			if !result.Allowed {
+				h.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				writeError(w, r, ErrRateLimited)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// userKey keys requests by the authorized user, it must be used after AuthorizationVerifier.
+func userKey(r *http.Request) string {
+	userData, ok := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+	if !ok {
+		return ""
+	}
+	return strconv.FormatInt(userData.ID, 10)
+}
+
+// clientIPKey keys requests by the client IP, see clientIP.
+func clientIPKey(trustedProxies []netip.Prefix) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		addr, ok := clientIP(r, trustedProxies)
+		if !ok {
+			return ""
+		}
+		return addr.String()
+	}
+}
+
+// clientIP returns the address of the peer unless it is a trusted proxy.
+// Then X-Forwarded-For is walked from the end, proxies append the address
+// of their peer to it, and the first untrusted address is the client.
+// If all the addresses are trusted the first one is the client.
+func clientIP(r *http.Request, trustedProxies []netip.Prefix) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+
+	if !isTrustedProxy(addr, trustedProxies) {
+		return addr, true
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			// A malformed hop was not added by a trusted proxy.
+			break
+		}
+		addr = hop.Unmap()
+		if !isTrustedProxy(addr, trustedProxies) {
+			break
+		}
+	}
+	return addr, true
+}
+
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
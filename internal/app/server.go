@@ -3,72 +3,594 @@ package app
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/jwtauth"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/accrual"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/events"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/metrics"
+	pb "github.com/r4start/go-musthave-diploma-tpl/internal/proto"
 	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"net"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	privateKeySize           = 32
-	compressionLevel         = 7
-	requestProcessingTimeout = 60 * time.Second
+	privateKeySize = 32
+
+	DefaultCompressionLevel = 7
+	DefaultRequestTimeout   = 60 * time.Second
 )
 
-func RunServerApp(ctx context.Context, serverAddress string, logger *zap.Logger, st storage.AppStorage) {
+type ServerConfig struct {
+	Address    string
+	AdminToken string
+	// ValidateRequests enables validation of request bodies
+	// against the OpenAPI document.
+	ValidateRequests bool
+	// StreamHeartbeatInterval is how often idle event streams are pinged.
+	StreamHeartbeatInterval time.Duration
+	// GRPCAddress is the address of the gRPC API, it is disabled if empty.
+	GRPCAddress string
+	// RequestTimeout bounds processing of a request, streams and exports excluded.
+	RequestTimeout time.Duration
+	// CompressionLevel is the gzip level of responses.
+	CompressionLevel int
+	// ReadinessTimeout bounds the dependency checks of the readiness probe.
+	ReadinessTimeout time.Duration
+	// InternalAddress is the address of the listener serving metrics,
+	// profiles, the admin API and the accrual callback. They are served
+	// on Address if it is empty, profiles excluded.
+	InternalAddress string
+	// TLS enables HTTPS and TLS for gRPC.
+	TLS TLSConfig
+	// RateLimit limits requests to the public HTTP API and the gRPC API.
+	RateLimit RateLimitConfig
+	// CORSOrigins are the origins allowed to call the public HTTP API
+	// from browsers, "*" allows any origin.
+	CORSOrigins []string
+	// LoginLockout locks a login after repeated failed attempts.
+	LoginLockout LockoutPolicy
+}
+
+// Server serves the HTTP API and, if configured, the gRPC API.
+type Server struct {
+	cfg    ServerConfig
+	logger *zap.Logger
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	httpServer     *http.Server
+	internalServer *http.Server
+	grpcServer     *grpc.Server
+	redirectServer *http.Server
+	certs          *certReloader
+
+	// routes and internalRoutes are the documented routes of the listeners.
+	routes         chi.Routes
+	internalRoutes chi.Routes
+
+	// tuning holds the current Tuning, it can be changed with SetTuning.
+	tuning  atomic.Value
+	lockout *loginLockout
+}
+
+// Tuning holds the settings which can be changed while the server runs.
+type Tuning struct {
+	RequestTimeout time.Duration
+	CORSOrigins    []string
+	LoginLockout   LockoutPolicy
+}
+
+// NewServer builds the APIs. It doesn't listen, the server
+// is started with Start and stopped with Stop.
+func NewServer(ctx context.Context, cfg ServerConfig, logger *zap.Logger, st storage.AppStorage, updater *accrual.Updater, bus *events.Bus, m *metrics.Metrics) (*Server, error) {
 	privateKey := make([]byte, privateKeySize)
 	readBytes, err := rand.Read(privateKey)
 	if err != nil || readBytes != privateKeySize {
-		logger.Fatal("Failed to generate private key", zap.Error(err), zap.Int("generated_len", readBytes))
+		return nil, fmt.Errorf("failed to generate private key: %w", err)
 	}
 
 	authorizer := jwtauth.New("HS256", privateKey, nil)
 
-	authServer, err := NewAuthServer(ctx, logger, st, authorizer)
+	if cfg.RequestTimeout <= 0 {
+		cfg.RequestTimeout = DefaultRequestTimeout
+	}
+	if cfg.CompressionLevel == 0 {
+		cfg.CompressionLevel = DefaultCompressionLevel
+	}
+
+	// Long-lived handlers such as event streams finish when ctx is canceled.
+	ctx, cancel := context.WithCancel(ctx)
+	server := &Server{
+		cfg:    cfg,
+		logger: logger,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	server.SetTuning(Tuning{
+		RequestTimeout: cfg.RequestTimeout,
+		CORSOrigins:    cfg.CORSOrigins,
+		LoginLockout:   cfg.LoginLockout,
+	})
+	server.lockout = newLoginLockout(func() LockoutPolicy {
+		return server.Tuning().LoginLockout
+	})
+
+	if err := server.init(ctx, st, updater, bus, m, authorizer); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return server, nil
+}
+
+func (s *Server) init(ctx context.Context, st storage.AppStorage, updater *accrual.Updater, bus *events.Bus, m *metrics.Metrics, authorizer *jwtauth.JWTAuth) error {
+	cfg := s.cfg
+	logger := s.logger
+
+	authServer, err := NewAuthServer(ctx, logger, st, authorizer, s.lockout)
 	if err != nil {
-		logger.Fatal("Failed to initialize auth server", zap.Error(err))
+		return fmt.Errorf("failed to initialize auth server: %w", err)
 	}
 
-	martServer, err := NewAppServer(ctx, logger, st)
+	martServer, err := NewAppServer(ctx, logger, st, bus)
 	if err != nil {
-		logger.Fatal("Failed to initialize app server", zap.Error(err))
+		return fmt.Errorf("failed to initialize app server: %w", err)
 	}
 
-	r := chi.NewRouter()
-	r.Use(middleware.NoCache)
-	r.Use(middleware.Compress(compressionLevel))
-	r.Use(DecompressGzip)
-	r.Use(middleware.Timeout(requestProcessingTimeout))
+	streamServer, err := NewStreamServer(ctx, logger, bus, cfg.StreamHeartbeatInterval)
+	if err != nil {
+		return fmt.Errorf("failed to initialize stream server: %w", err)
+	}
 
-	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "", http.StatusBadRequest)
-	})
+	wsServer, err := NewWSServer(ctx, logger, bus)
+	if err != nil {
+		return fmt.Errorf("failed to initialize websocket server: %w", err)
+	}
+
+	adminServer, err := NewAdminServer(ctx, logger, st, bus)
+	if err != nil {
+		return fmt.Errorf("failed to initialize admin server: %w", err)
+	}
+
+	healthServer, err := NewHealthServer(ctx, logger, st, updater, cfg.ReadinessTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to initialize health server: %w", err)
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLS.Enabled() {
+		if s.certs, err = newCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile, logger); err != nil {
+			return fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		if tlsConfig, err = newServerTLSConfig(cfg.TLS, s.certs); err != nil {
+			return fmt.Errorf("failed to configure TLS: %w", err)
+		}
+	}
 
+	spec, err := LoadOpenAPISpec()
+	if err != nil {
+		return fmt.Errorf("failed to load OpenAPI document: %w", err)
+	}
+
+	// Request bodies are validated after authentication and rate limiting
+	// where they apply. Register and login are public, the bodies parsed
+	// for them are bounded by MaxValidatedBodySize.
+	validate := func(r chi.Router) {}
+	if cfg.ValidateRequests {
+		validate = func(r chi.Router) {
+			r.Use(RequestValidator(spec))
+		}
+	}
+
+	// Internal routes require a client certificate if mTLS is configured
+	// and they are served by the public listener.
+	internal := func(r chi.Router) {}
+	if len(cfg.InternalAddress) == 0 && tlsConfig != nil && tlsConfig.ClientCAs != nil {
+		internal = func(r chi.Router) {
+			r.Use(RequireClientCert)
+		}
+	}
+
+	// Operational routes are served by the internal listener if it is
+	// configured, otherwise by the public one.
+	operational := func(r chi.Router) {
+		if m != nil {
+			// The handler compresses the response itself.
+			r.With(middleware.NoCache).Method(http.MethodGet, "/metrics", m.Handler())
+		}
+
+		r.Group(func(r chi.Router) {
+			internal(r)
+			r.Use(middleware.NoCache)
+			r.Use(s.timeout)
+
+			r.Get("/internal/openapi.json", spec.apiGetInternalDocument)
+
+			r.Route("/internal/accrual", func(r chi.Router) {
+				// Callbacks are authenticated by their signature.
+				validate(r)
+
+				r.Get("/health", updater.HandleHealth)
+				if updater.CallbackEnabled() {
+					r.Post("/callback", updater.HandleCallback)
+				}
+			})
+
+			if len(cfg.AdminToken) != 0 {
+				r.Route("/internal/admin", func(r chi.Router) {
+					r.Use(AdminAuthorization(cfg.AdminToken))
+					validate(r)
+
+					r.Get("/orders/stuck", adminServer.apiGetStuckOrders)
+					r.Post("/orders/{number}/repoll", adminServer.apiRepollOrder)
+					r.Post("/orders/{number}/invalidate", adminServer.apiInvalidateOrder)
+					r.Post("/orders/{number}/credit", adminServer.apiCreditOrder)
+				})
+			}
+		})
+	}
+
+	// Order uploads and withdrawals are limited on top of the user limit.
+	rl := cfg.RateLimit
+	limitOrders := RateLimit(rl.Store, "orders", rl.Orders, userKey, logger)
+	limitWithdraw := RateLimit(rl.Store, "withdraw", rl.Withdraw, userKey, logger)
+
+	r := newRouter(logger, m)
+	r.Use(s.cors)
+	r.Use(DecompressGzip)
+
+	// Probes are cheap and frequent, they are neither authorized
+	// nor compressed by the router. The public readiness probe leaves
+	// out the check errors and details.
 	r.Group(func(r chi.Router) {
-		r.Post("/api/user/register", authServer.apiUserRegister)
-		r.Post("/api/user/login", authServer.apiUserLogin)
+		r.Use(middleware.NoCache)
+
+		r.Get("/healthz", healthServer.apiLiveness)
+		r.Get("/readyz", healthServer.apiPublicReadiness)
 	})
 
+	if len(cfg.InternalAddress) == 0 {
+		operational(r)
+	}
+
 	r.Group(func(r chi.Router) {
-		r.Use(jwtauth.Verifier(authorizer))
-		r.Use(jwtauth.Authenticator)
-		r.Use(AuthorizationVerifier(st))
+		r.Use(middleware.Compress(cfg.CompressionLevel))
+
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.NoCache)
+			r.Use(s.timeout)
+
+			r.Get("/api/openapi.json", spec.apiGetDocument)
+
+			r.Group(func(r chi.Router) {
+				r.Use(RateLimit(rl.Store, "login", rl.Login, clientIPKey(rl.TrustedProxies), logger))
+				validate(r)
+
+				r.Post("/api/user/register", authServer.apiUserRegister)
+				r.Post("/api/user/login", authServer.apiUserLogin)
+			})
+		})
 
-		r.Route("/api/user/orders", func(r chi.Router) {
-			r.Get("/", martServer.apiGetUserOrders)
-			r.Post("/", martServer.apiAddUserOrder)
+		r.Group(func(r chi.Router) {
+			r.Use(jwtauth.Verifier(authorizer))
+			r.Use(AuthorizationVerifier(st))
+			r.Use(RateLimit(rl.Store, "user", rl.User, userKey, logger))
+			validate(r)
+
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.NoCache)
+
+				// Event streams stay open as long as the client is connected,
+				// so they are not limited by the request processing timeout.
+				r.Get("/api/user/orders/stream", streamServer.apiStreamUserEvents)
+				r.Get("/api/user/ws", wsServer.apiUserWebSocket)
+				// The export is streamed, its duration depends on the history size.
+				r.Get("/api/user/export", martServer.apiExportUserHistory)
+			})
+
+			r.Group(func(r chi.Router) {
+				r.Use(s.timeout)
+
+				r.Route("/api/user/orders", func(r chi.Router) {
+					r.With(ConditionalGET).Get("/", martServer.apiGetUserOrders)
+
+					r.Group(func(r chi.Router) {
+						r.Use(middleware.NoCache)
+						r.With(limitOrders).Post("/", martServer.apiAddUserOrder)
+						r.With(limitOrders).Post("/batch", martServer.apiAddUserOrdersBatch)
+						r.Get("/{number}", martServer.apiGetUserOrder)
+					})
+				})
+
+				r.Route("/api/user/balance", func(r chi.Router) {
+					r.Group(func(r chi.Router) {
+						r.Use(ConditionalGET)
+						r.Get("/", martServer.apiGetUserBalance)
+						r.Get("/withdrawals", martServer.apiGetUserWithdrawals)
+					})
+
+					r.With(middleware.NoCache, limitWithdraw).Post("/withdraw", martServer.apiBalanceWithdraw)
+				})
+			})
 		})
+	})
+
+	s.routes = r
+	s.httpServer = &http.Server{
+		Addr:      cfg.Address,
+		Handler:   otelhttp.NewHandler(r, "http.request", otelhttp.WithFilter(isTracedRequest)),
+		TLSConfig: tlsConfig,
+	}
+
+	if len(cfg.InternalAddress) != 0 {
+		ir := newRouter(logger.With(zap.String("listener", "internal")), m)
+		ir.Use(DecompressGzip)
+
+		ir.Group(func(r chi.Router) {
+			r.Use(middleware.NoCache)
 
-		r.Route("/api/user/balance", func(r chi.Router) {
-			r.Get("/", martServer.apiGetUserBalance)
-			r.Get("/withdrawals", martServer.apiGetUserWithdrawals)
-			r.Post("/withdraw", martServer.apiBalanceWithdraw)
+			r.Get("/healthz", healthServer.apiLiveness)
+			r.Get("/readyz", healthServer.apiReadiness)
 		})
+		operational(ir)
+		s.internalRoutes = ir
+
+		// Profiles expose the process internals, they are not a part of the API.
+		if len(cfg.AdminToken) != 0 {
+			ir.With(AdminAuthorization(cfg.AdminToken)).Mount("/debug", middleware.Profiler())
+		}
+
+		// The whole listener requires a client certificate with mTLS.
+		var internalTLSConfig *tls.Config
+		if tlsConfig != nil {
+			internalTLSConfig = tlsConfig.Clone()
+			if internalTLSConfig.ClientCAs != nil {
+				internalTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+		}
+
+		s.internalServer = &http.Server{
+			Addr:      cfg.InternalAddress,
+			Handler:   otelhttp.NewHandler(ir, "http.request", otelhttp.WithFilter(isTracedRequest)),
+			TLSConfig: internalTLSConfig,
+		}
+	}
+
+	if tlsConfig != nil && len(cfg.TLS.RedirectAddress) != 0 {
+		s.redirectServer = &http.Server{
+			Addr:    cfg.TLS.RedirectAddress,
+			Handler: httpsRedirect(cfg.Address),
+		}
+	}
+
+	if len(cfg.GRPCAddress) != 0 {
+		grpcServer, err := NewGRPCServer(ctx, logger, st, authorizer, bus, s.lockout)
+		if err != nil {
+			return fmt.Errorf("failed to initialize gRPC server: %w", err)
+		}
+
+		opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(
+			GRPCLoggingInterceptor(logger),
+			GRPCTimeoutInterceptor(s.RequestTimeout),
+			GRPCAuthInterceptor(st, authorizer),
+			GRPCRateLimitInterceptor(cfg.RateLimit, logger),
+		)}
+		if tlsConfig != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+
+		s.grpcServer = grpc.NewServer(opts...)
+		pb.RegisterGophermartServer(s.grpcServer, grpcServer)
+	}
+
+	return nil
+}
+
+// SetTuning replaces the settings, requests in progress keep the previous ones.
+func (s *Server) SetTuning(t Tuning) {
+	if t.RequestTimeout <= 0 {
+		t.RequestTimeout = DefaultRequestTimeout
+	}
+	if t.LoginLockout.Duration <= 0 {
+		t.LoginLockout.Duration = DefaultLockoutDuration
+	}
+	s.tuning.Store(t)
+}
+
+// Tuning returns the settings currently used by the server.
+func (s *Server) Tuning() Tuning {
+	return s.tuning.Load().(Tuning)
+}
+
+// RequestTimeout returns the current request processing timeout.
+func (s *Server) RequestTimeout() time.Duration {
+	return s.Tuning().RequestTimeout
+}
+
+// timeout is middleware.Timeout with the current request processing timeout.
+func (s *Server) timeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		middleware.Timeout(s.RequestTimeout())(next).ServeHTTP(w, r)
 	})
+}
+
+// newRouter returns a router with the middleware shared by the listeners.
+func newRouter(logger *zap.Logger, m *metrics.Metrics) *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(RequestID)
+	r.Use(AccessLog(logger))
+	r.Use(TraceRoute)
+	if m != nil {
+		r.Use(RequestMetrics(m))
+	}
+
+	r.MethodNotAllowed(middleware.NoCache(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, ErrMethodNotAllowed)
+	})).ServeHTTP)
+	r.NotFound(middleware.NoCache(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, ErrRouteNotFound)
+	})).ServeHTTP)
+
+	return r
+}
+
+// isTracedRequest leaves out probes, scrapes and profiles, they would only add noise.
+func isTracedRequest(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/healthz", "/readyz", "/metrics":
+		return false
+	}
+	return !strings.HasPrefix(r.URL.Path, "/debug/")
+}
+
+// Start listens on the configured addresses and serves in the background.
+// Listening errors are returned, serving errors are passed to fail.
+func (s *Server) Start(fail func(error)) error {
+	var listeners []net.Listener
+	listen := func(address, what string) (net.Listener, error) {
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen%s: %w", what, err)
+		}
+		listeners = append(listeners, l)
+		return l, nil
+	}
+
+	listener, err := listen(s.httpServer.Addr, "")
+	if err != nil {
+		return err
+	}
+
+	var internalListener net.Listener
+	if s.internalServer != nil {
+		if internalListener, err = listen(s.internalServer.Addr, " for internal routes"); err != nil {
+			return err
+		}
+	}
+
+	var grpcListener net.Listener
+	if s.grpcServer != nil {
+		if grpcListener, err = listen(s.cfg.GRPCAddress, " for gRPC"); err != nil {
+			return err
+		}
+	}
+
+	var redirectListener net.Listener
+	if s.redirectServer != nil {
+		if redirectListener, err = listen(s.redirectServer.Addr, " for HTTPS redirects"); err != nil {
+			return err
+		}
+	}
+
+	go serveHTTP(s.httpServer, listener, func(err error) {
+		fail(fmt.Errorf("failed to serve: %w", err))
+	})
+
+	if internalListener != nil {
+		go serveHTTP(s.internalServer, internalListener, func(err error) {
+			fail(fmt.Errorf("failed to serve internal routes: %w", err))
+		})
+	}
+
+	if redirectListener != nil {
+		go serveHTTP(s.redirectServer, redirectListener, func(err error) {
+			fail(fmt.Errorf("failed to serve HTTPS redirects: %w", err))
+		})
+	}
+
+	if s.certs != nil {
+		reloadInterval := s.cfg.TLS.ReloadInterval
+		if reloadInterval <= 0 {
+			reloadInterval = DefaultCertReloadInterval
+		}
+		go s.certs.watch(s.ctx, reloadInterval)
+	}
+
+	if grpcListener != nil {
+		go func() {
+			if err := s.grpcServer.Serve(grpcListener); err != nil {
+				fail(fmt.Errorf("failed to serve gRPC: %w", err))
+			}
+		}()
+	}
+
+	return nil
+}
+
+// serveHTTP serves until the server is shut down, other errors are passed to fail.
+func serveHTTP(server *http.Server, listener net.Listener, fail func(error)) {
+	var err error
+	if server.TLSConfig != nil {
+		// The certificate comes from TLSConfig, HTTP/2 is enabled by ServeTLS.
+		err = server.ServeTLS(listener, "", "")
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		fail(err)
+	}
+}
+
+// Stop waits for active requests to finish until ctx is done,
+// then the remaining connections are closed.
+func (s *Server) Stop(ctx context.Context) error {
+	s.cancel()
+
+	var result error
+	if s.redirectServer != nil {
+		if err := s.redirectServer.Shutdown(ctx); err != nil {
+			s.redirectServer.Close()
+		}
+	}
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		s.logger.Error("Failed to shutdown server gracefully", zap.Error(err))
+		s.httpServer.Close()
+		result = err
+	}
+
+	if s.internalServer != nil {
+		if err := s.internalServer.Shutdown(ctx); err != nil {
+			s.logger.Error("Failed to shutdown internal server gracefully", zap.Error(err))
+			s.internalServer.Close()
+			if result == nil {
+				result = err
+			}
+		}
+	}
+
+	if s.grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			s.grpcServer.GracefulStop()
+			close(stopped)
+		}()
+
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			s.logger.Error("Failed to shutdown gRPC server gracefully")
+			s.grpcServer.Stop()
+			if result == nil {
+				result = ctx.Err()
+			}
+		}
+	}
 
-	server := &http.Server{Addr: serverAddress, Handler: r}
-	server.ListenAndServe()
+	return result
 }
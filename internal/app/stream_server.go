@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/events"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/logging"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultStreamHeartbeatInterval = 15 * time.Second
+
+	lastEventIDHeader = "Last-Event-ID"
+	streamRetryDelay  = 3 * time.Second
+)
+
+// StreamServer pushes events of the authenticated user as Server-Sent Events.
+type StreamServer struct {
+	ctx               context.Context
+	logger            *zap.Logger
+	bus               *events.Bus
+	heartbeatInterval time.Duration
+}
+
+func NewStreamServer(ctx context.Context, logger *zap.Logger, bus *events.Bus, heartbeatInterval time.Duration) (*StreamServer, error) {
+	if heartbeatInterval <= 0 {
+		heartbeatInterval = DefaultStreamHeartbeatInterval
+	}
+
+	server := &StreamServer{
+		ctx:               ctx,
+		logger:            logger,
+		bus:               bus,
+		heartbeatInterval: heartbeatInterval,
+	}
+
+	return server, nil
+}
+
+func (s *StreamServer) apiStreamUserEvents(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logger.Error("response writer doesn't support flushing")
+		writeError(w, r, ErrStreamingUnsupported)
+		return
+	}
+
+	lastEventID := uint64(0)
+	if value := r.Header.Get(lastEventIDHeader); len(value) != 0 {
+		id, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeError(w, r, ErrBadLastEventID)
+			return
+		}
+		lastEventID = id
+	}
+
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	subscription, missed, err := s.bus.Subscribe(userData.ID, lastEventID)
+	if err != nil {
+		logger.Info("event subscription rejected", zap.Int64("user_id", userData.ID), zap.Error(err))
+		writeError(w, r, err)
+		return
+	}
+	defer subscription.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if _, err := fmt.Fprintf(w, "retry: %d\n\n", streamRetryDelay.Milliseconds()); err != nil {
+		return
+	}
+	for _, e := range missed {
+		if err := writeEvent(w, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(s.heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+		select {
+		case e, ok := <-subscription.Events():
+			if !ok {
+				// The client fell behind, it reconnects with Last-Event-ID
+				// and catches up from the history.
+				logger.Info("event subscription dropped", zap.Int64("user_id", userData.ID))
+				return
+			}
+			err = writeEvent(w, e)
+		case <-heartbeat.C:
+			_, err = io.WriteString(w, ": heartbeat\n\n")
+		case <-r.Context().Done():
+			return
+		case <-s.ctx.Done():
+			return
+		}
+
+		if err != nil {
+			logger.Debug("failed to write event", zap.Int64("user_id", userData.ID), zap.Error(err))
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, e events.Event) error {
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
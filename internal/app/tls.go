@@ -0,0 +1,245 @@
+package app
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultCertReloadInterval = time.Minute
+
+var (
+	ErrUnknownTLSVersion  = errors.New("unknown TLS version, expected 1.2 or 1.3")
+	ErrUnknownCipherSuite = errors.New("unknown or insecure cipher suite")
+	ErrNoClientCAs        = errors.New("no certificates found in client CA file")
+)
+
+// TLSConfig enables HTTPS if CertFile is set. HTTP/2 is negotiated
+// with clients supporting it.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// MinVersion is tls.VersionTLS12 if it is not set.
+	MinVersion uint16
+	// CipherSuites restricts TLS 1.2 cipher suites, Go defaults are used if empty.
+	CipherSuites []uint16
+	// ClientCAFile enables mTLS for the internal routes: their clients
+	// must present a certificate signed by one of these CAs.
+	ClientCAFile string
+	// ReloadInterval is how often the certificate files are checked for changes.
+	ReloadInterval time.Duration
+	// RedirectAddress is the address of a plain HTTP listener
+	// redirecting to HTTPS, it is disabled if empty.
+	RedirectAddress string
+}
+
+func (c TLSConfig) Enabled() bool {
+	return len(c.CertFile) != 0
+}
+
+// ParseTLSVersion parses "1.2" or "1.3".
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, ErrUnknownTLSVersion
+}
+
+// ParseCipherSuites maps names such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+// to cipher suite IDs. Suites Go considers insecure are rejected.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownCipherSuite, name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// HTTP2CipherSuiteMissing reports whether HTTP/2 can't be served with the
+// suites: it requires TLS_ECDHE_*_WITH_AES_128_GCM_SHA256 for TLS 1.2.
+func HTTP2CipherSuiteMissing(minVersion uint16, suites []uint16) bool {
+	if len(suites) == 0 || minVersion >= tls.VersionTLS13 {
+		return false
+	}
+	for _, id := range suites {
+		if id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return false
+		}
+	}
+	return true
+}
+
+// certReloader serves the certificate loaded from files and reloads it
+// when the files change. A broken update is logged, the previous
+// certificate stays in use.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *zap.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string, logger *zap.Logger) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// watch checks the files every interval until ctx is done.
+func (r *certReloader) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := r.reload()
+			if err != nil {
+				r.logger.Error("Failed to reload TLS certificate", zap.String("cert_file", r.certFile), zap.Error(err))
+				continue
+			}
+			if reloaded {
+				r.logger.Info("TLS certificate reloaded", zap.String("cert_file", r.certFile))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload loads the files if either of them is newer than the loaded certificate.
+func (r *certReloader) reload() (bool, error) {
+	modTime, err := latestModTime(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.RLock()
+	unchanged := r.cert != nil && !modTime.After(r.modTime)
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return true, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// newServerTLSConfig builds the TLS config of the API listeners. With mTLS
+// client certificates are verified if presented, RequireClientCert
+// rejects requests to the internal routes without one.
+func newServerTLSConfig(cfg TLSConfig, certs *certReloader) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:     cfg.MinVersion,
+		CipherSuites:   cfg.CipherSuites,
+		GetCertificate: certs.GetCertificate,
+	}
+	if tlsConfig.MinVersion == 0 {
+		tlsConfig.MinVersion = tls.VersionTLS12
+	}
+
+	if len(cfg.ClientCAFile) != 0 {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, ErrNoClientCAs
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// RequireClientCert lets through requests made with a verified client certificate.
+func RequireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			writeError(w, r, ErrClientCertRequired)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpsRedirect redirects to the same URL on the HTTPS listener.
+// The method and body are preserved by 308.
+func httpsRedirect(httpsAddress string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddress)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(r.Host, "[]")
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if len(port) != 0 && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
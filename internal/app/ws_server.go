@@ -0,0 +1,244 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/events"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/logging"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	wsWriteTimeout   = 10 * time.Second
+	wsPongTimeout    = 60 * time.Second
+	wsPingInterval   = 30 * time.Second
+	wsMaxMessageSize = 4096
+
+	wsActionSubscribe   = "subscribe"
+	wsActionUnsubscribe = "unsubscribe"
+
+	wsMessageSubscriptions = "subscriptions"
+	wsMessageError         = "error"
+)
+
+var wsEventTypes = []string{
+	events.TypeBalanceChanged,
+	events.TypeOrderStatusChanged,
+	events.TypeWithdrawalCompleted,
+}
+
+// WSServer delivers events of the authenticated user over a WebSocket.
+// Clients choose the events they want with subscribe/unsubscribe commands.
+type WSServer struct {
+	ctx      context.Context
+	logger   *zap.Logger
+	bus      *events.Bus
+	upgrader websocket.Upgrader
+}
+
+type wsCommand struct {
+	Action string   `json:"action"`
+	Events []string `json:"events"`
+}
+
+type wsEventMessage struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+	Time time.Time   `json:"time"`
+}
+
+type wsSubscriptionsMessage struct {
+	Type   string   `json:"type"`
+	Events []string `json:"events"`
+}
+
+type wsErrorMessage struct {
+	Type  string `json:"type"`
+	Error string `json:"error"`
+}
+
+type wsEventFilter map[string]bool
+
+func NewWSServer(ctx context.Context, logger *zap.Logger, bus *events.Bus) (*WSServer, error) {
+	server := &WSServer{
+		ctx:    ctx,
+		logger: logger,
+		bus:    bus,
+		upgrader: websocket.Upgrader{
+			HandshakeTimeout: wsWriteTimeout,
+		},
+	}
+
+	return server, nil
+}
+
+func (s *WSServer) apiUserWebSocket(w http.ResponseWriter, r *http.Request) {
+	logger := logging.FromContext(r.Context(), s.logger)
+
+	userData := r.Context().Value(UserAuthDataCtxKey).(*storage.UserAuthorization)
+
+	filter := wsEventFilter{}
+	if value := r.URL.Query().Get("events"); len(value) != 0 {
+		if err := filter.apply(wsActionSubscribe, strings.Split(value, ",")); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	} else {
+		_ = filter.apply(wsActionSubscribe, wsEventTypes)
+	}
+
+	subscription, _, err := s.bus.Subscribe(userData.ID, 0)
+	if err != nil {
+		logger.Info("event subscription rejected", zap.Int64("user_id", userData.ID), zap.Error(err))
+		writeError(w, r, err)
+		return
+	}
+	defer subscription.Close()
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied with an error.
+		logger.Info("failed to upgrade connection", zap.Int64("user_id", userData.ID), zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	commands := make(chan wsCommand)
+	go s.readCommands(conn, commands, done)
+
+	if err := s.write(conn, filter.message()); err != nil {
+		return
+	}
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case e, ok := <-subscription.Events():
+			if !ok {
+				logger.Info("slow websocket client dropped", zap.Int64("user_id", userData.ID))
+				s.close(conn, websocket.CloseTryAgainLater, "client is too slow")
+				return
+			}
+			if !filter[e.Type] {
+				continue
+			}
+			err = s.write(conn, wsEventMessage{ID: e.ID, Type: e.Type, Data: e.Data, Time: e.Time})
+		case cmd, ok := <-commands:
+			if !ok {
+				return
+			}
+			if applyErr := filter.apply(cmd.Action, cmd.Events); applyErr != nil {
+				err = s.write(conn, wsErrorMessage{Type: wsMessageError, Error: applyErr.Error()})
+			} else {
+				err = s.write(conn, filter.message())
+			}
+		case <-ping.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+		case <-s.ctx.Done():
+			s.close(conn, websocket.CloseGoingAway, "server is shutting down")
+			return
+		}
+
+		if err != nil {
+			logger.Debug("failed to write websocket message", zap.Int64("user_id", userData.ID), zap.Error(err))
+			return
+		}
+	}
+}
+
+// readCommands reads client commands until the connection is closed.
+// Replies are written by the caller, the connection supports
+// only one concurrent writer.
+func (s *WSServer) readCommands(conn *websocket.Conn, commands chan<- wsCommand, done <-chan struct{}) {
+	defer close(commands)
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	_ = conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		// Malformed commands are answered with an error as unknown actions.
+		cmd := wsCommand{}
+		_ = json.Unmarshal(b, &cmd)
+
+		select {
+		case commands <- cmd:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *WSServer) write(conn *websocket.Conn, msg interface{}) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
+		return err
+	}
+	return conn.WriteJSON(msg)
+}
+
+func (s *WSServer) close(conn *websocket.Conn, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteTimeout))
+}
+
+func (f wsEventFilter) apply(action string, eventTypes []string) error {
+	for _, t := range eventTypes {
+		if !isWSEventType(t) {
+			return ErrUnknownEventType
+		}
+	}
+
+	switch action {
+	case wsActionSubscribe:
+		for _, t := range eventTypes {
+			f[t] = true
+		}
+	case wsActionUnsubscribe:
+		for _, t := range eventTypes {
+			delete(f, t)
+		}
+	default:
+		return ErrBadWSCommand
+	}
+
+	return nil
+}
+
+func (f wsEventFilter) message() wsSubscriptionsMessage {
+	eventTypes := make([]string, 0, len(f))
+	for t := range f {
+		eventTypes = append(eventTypes, t)
+	}
+	sort.Strings(eventTypes)
+
+	return wsSubscriptionsMessage{Type: wsMessageSubscriptions, Events: eventTypes}
+}
+
+func isWSEventType(eventType string) bool {
+	for _, t := range wsEventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
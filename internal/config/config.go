@@ -0,0 +1,515 @@
+package config
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/accrual"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/app"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/events"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/lifecycle"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/ratelimit"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/tracing"
+	"go.uber.org/zap/zapcore"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultServerAddress = ":8080"
+	// DefaultInternalAddress is reachable from the host only, the internal
+	// listener is exposed by setting an address explicitly.
+	DefaultInternalAddress = "localhost:8090"
+	DefaultShutdownTimeout = 30 * time.Second
+	DefaultDrainTimeout    = 15 * time.Second
+	DefaultLogLevel        = "info"
+	DefaultTLSMinVersion   = "1.2"
+
+	DefaultLockoutMaxFailures = 10
+
+	RateLimitStoreMemory   = "memory"
+	RateLimitStorePostgres = "postgres"
+)
+
+// Config is the whole service configuration. Every field can be set in the
+// config file, by an env var and by a flag, see settings.
+type Config struct {
+	Log       LogConfig       `yaml:"log" json:"log"`
+	Server    ServerConfig    `yaml:"server" json:"server"`
+	Database  DatabaseConfig  `yaml:"database" json:"database"`
+	Accrual   AccrualConfig   `yaml:"accrual" json:"accrual"`
+	Events    EventsConfig    `yaml:"events" json:"events"`
+	Tracing   TracingConfig   `yaml:"tracing" json:"tracing"`
+	Lifecycle LifecycleConfig `yaml:"lifecycle" json:"lifecycle"`
+}
+
+type LogConfig struct {
+	// Level is one of debug, info, warn or error.
+	// An empty level is info.
+	Level string `yaml:"level" json:"level"`
+}
+
+type ServerConfig struct {
+	Address          string   `yaml:"address" json:"address"`
+	GRPCAddress      string   `yaml:"grpc_address" json:"grpc_address"`
+	InternalAddress  string   `yaml:"internal_address" json:"internal_address"`
+	AdminToken       string   `yaml:"admin_token" json:"admin_token"`
+	ValidateRequests bool     `yaml:"validate_requests" json:"validate_requests"`
+	RequestTimeout   Duration `yaml:"request_timeout" json:"request_timeout"`
+	CompressionLevel int      `yaml:"compression_level" json:"compression_level"`
+	ReadinessTimeout Duration `yaml:"readiness_timeout" json:"readiness_timeout"`
+	ShutdownTimeout  Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+
+	StreamHeartbeatInterval Duration `yaml:"stream_heartbeat_interval" json:"stream_heartbeat_interval"`
+
+	// CORSOrigins are the origins allowed to call the API from browsers.
+	CORSOrigins  []string      `yaml:"cors_origins" json:"cors_origins"`
+	LoginLockout LockoutConfig `yaml:"login_lockout" json:"login_lockout"`
+
+	TLS       TLSConfig       `yaml:"tls" json:"tls"`
+	RateLimit RateLimitConfig `yaml:"rate_limit" json:"rate_limit"`
+}
+
+// TLSConfig enables HTTPS if CertFile and KeyFile are set.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string `yaml:"key_file" json:"key_file"`
+	// MinVersion is "1.2" or "1.3".
+	MinVersion string `yaml:"min_version" json:"min_version"`
+	// CipherSuites are Go names of TLS 1.2 suites, Go defaults are used if empty.
+	CipherSuites   []string `yaml:"cipher_suites" json:"cipher_suites"`
+	ClientCAFile   string   `yaml:"client_ca_file" json:"client_ca_file"`
+	ReloadInterval Duration `yaml:"reload_interval" json:"reload_interval"`
+	// RedirectAddress is the address of the HTTP to HTTPS redirect listener.
+	RedirectAddress string `yaml:"redirect_address" json:"redirect_address"`
+}
+
+// LockoutConfig locks a login after MaxFailures failed attempts, zero disables it.
+type LockoutConfig struct {
+	MaxFailures int      `yaml:"max_failures" json:"max_failures"`
+	Duration    Duration `yaml:"duration" json:"duration"`
+}
+
+// RateLimitConfig limits requests to the public HTTP API if Enabled is set.
+type RateLimitConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Store is "memory" or "postgres", the latter shares limits between instances.
+	Store string `yaml:"store" json:"store"`
+	// TrustedProxies are IP addresses or CIDR prefixes of reverse proxies.
+	TrustedProxies []string `yaml:"trusted_proxies" json:"trusted_proxies"`
+
+	Login    PolicyConfig `yaml:"login" json:"login"`
+	User     PolicyConfig `yaml:"user" json:"user"`
+	Orders   PolicyConfig `yaml:"orders" json:"orders"`
+	Withdraw PolicyConfig `yaml:"withdraw" json:"withdraw"`
+}
+
+// PolicyConfig is a token bucket, zero rate disables the policy.
+type PolicyConfig struct {
+	// Rate is the number of requests per second.
+	Rate float64 `yaml:"rate" json:"rate"`
+	// Burst is the number of requests allowed at once.
+	Burst int `yaml:"burst" json:"burst"`
+}
+
+type DatabaseConfig struct {
+	URI              string   `yaml:"uri" json:"uri"`
+	OperationTimeout Duration `yaml:"operation_timeout" json:"operation_timeout"`
+	ExportTimeout    Duration `yaml:"export_timeout" json:"export_timeout"`
+}
+
+type AccrualConfig struct {
+	Address string `yaml:"address" json:"address"`
+	// PollInterval is the updater tick, zero picks the default
+	// depending on whether callbacks are enabled.
+	PollInterval Duration `yaml:"poll_interval" json:"poll_interval"`
+	// RetryCount is the number of retries of a failed request, zero disables them.
+	RetryCount           int      `yaml:"retry_count" json:"retry_count"`
+	CallbackSecret       string   `yaml:"callback_secret" json:"callback_secret"`
+	CallbackReplayWindow Duration `yaml:"callback_replay_window" json:"callback_replay_window"`
+	StuckCheckInterval   Duration `yaml:"stuck_check_interval" json:"stuck_check_interval"`
+	// DrainTimeout is how long in-flight polls may take on shutdown.
+	DrainTimeout Duration `yaml:"drain_timeout" json:"drain_timeout"`
+	// RateLimit is the number of requests per second, zero means no limit.
+	RateLimit float64 `yaml:"rate_limit" json:"rate_limit"`
+	RateBurst int     `yaml:"rate_burst" json:"rate_burst"`
+
+	Schedule ScheduleConfig `yaml:"schedule" json:"schedule"`
+	Breaker  BreakerConfig  `yaml:"breaker" json:"breaker"`
+}
+
+type ScheduleConfig struct {
+	InitialInterval Duration `yaml:"initial_interval" json:"initial_interval"`
+	FastAttempts    int      `yaml:"fast_attempts" json:"fast_attempts"`
+	Multiplier      float64  `yaml:"multiplier" json:"multiplier"`
+	MaxInterval     Duration `yaml:"max_interval" json:"max_interval"`
+	Jitter          float64  `yaml:"jitter" json:"jitter"`
+	MaxAge          Duration `yaml:"max_age" json:"max_age"`
+}
+
+type BreakerConfig struct {
+	FailureThreshold int      `yaml:"failure_threshold" json:"failure_threshold"`
+	OpenTimeout      Duration `yaml:"open_timeout" json:"open_timeout"`
+	HalfOpenRequests int      `yaml:"half_open_requests" json:"half_open_requests"`
+}
+
+type EventsConfig struct {
+	HistorySize             int `yaml:"history_size" json:"history_size"`
+	MaxSubscriptionsPerUser int `yaml:"max_subscriptions_per_user" json:"max_subscriptions_per_user"`
+}
+
+type TracingConfig struct {
+	Exporter     string `yaml:"exporter" json:"exporter"`
+	OTLPEndpoint string `yaml:"otlp_endpoint" json:"otlp_endpoint"`
+	OTLPInsecure bool   `yaml:"otlp_insecure" json:"otlp_insecure"`
+	ServiceName  string `yaml:"service_name" json:"service_name"`
+}
+
+type LifecycleConfig struct {
+	StartTimeout Duration `yaml:"start_timeout" json:"start_timeout"`
+	StopTimeout  Duration `yaml:"stop_timeout" json:"stop_timeout"`
+}
+
+// Default returns the configuration used when nothing is set.
+func Default() Config {
+	schedule := accrual.DefaultSchedulePolicy()
+	breaker := accrual.DefaultBreakerConfig()
+
+	return Config{
+		Log: LogConfig{
+			Level: DefaultLogLevel,
+		},
+		Server: ServerConfig{
+			Address:          DefaultServerAddress,
+			InternalAddress:  DefaultInternalAddress,
+			RequestTimeout:   Duration(app.DefaultRequestTimeout),
+			CompressionLevel: app.DefaultCompressionLevel,
+			ReadinessTimeout: Duration(app.DefaultReadinessTimeout),
+			ShutdownTimeout:  Duration(DefaultShutdownTimeout),
+
+			StreamHeartbeatInterval: Duration(app.DefaultStreamHeartbeatInterval),
+
+			LoginLockout: LockoutConfig{
+				MaxFailures: DefaultLockoutMaxFailures,
+				Duration:    Duration(app.DefaultLockoutDuration),
+			},
+
+			TLS: TLSConfig{
+				MinVersion:     DefaultTLSMinVersion,
+				ReloadInterval: Duration(app.DefaultCertReloadInterval),
+			},
+			RateLimit: RateLimitConfig{
+				Store:    RateLimitStoreMemory,
+				Login:    policyConfig(app.DefaultLoginRateLimit),
+				User:     policyConfig(app.DefaultUserRateLimit),
+				Orders:   policyConfig(app.DefaultOrdersRateLimit),
+				Withdraw: policyConfig(app.DefaultWithdrawRateLimit),
+			},
+		},
+		Database: DatabaseConfig{
+			OperationTimeout: Duration(storage.DefaultOperationTimeout),
+			ExportTimeout:    Duration(storage.DefaultExportTimeout),
+		},
+		Accrual: AccrualConfig{
+			RetryCount:           accrual.DefaultRetryCount,
+			CallbackReplayWindow: Duration(accrual.DefaultCallbackReplayWindow),
+			StuckCheckInterval:   Duration(accrual.DefaultStuckCheckInterval),
+			DrainTimeout:         Duration(DefaultDrainTimeout),
+			RateBurst:            accrual.DefaultRateBurst,
+			Schedule: ScheduleConfig{
+				InitialInterval: Duration(schedule.InitialInterval),
+				FastAttempts:    schedule.FastAttempts,
+				Multiplier:      schedule.Multiplier,
+				MaxInterval:     Duration(schedule.MaxInterval),
+				Jitter:          schedule.Jitter,
+				MaxAge:          Duration(schedule.MaxAge),
+			},
+			Breaker: BreakerConfig{
+				FailureThreshold: breaker.FailureThreshold,
+				OpenTimeout:      Duration(breaker.OpenTimeout),
+				HalfOpenRequests: breaker.HalfOpenRequests,
+			},
+		},
+		Events: EventsConfig{
+			HistorySize:             events.DefaultHistorySize,
+			MaxSubscriptionsPerUser: events.DefaultMaxSubscriptionsPerUser,
+		},
+		Tracing: TracingConfig{
+			ServiceName: tracing.DefaultServiceName,
+		},
+		Lifecycle: LifecycleConfig{
+			StartTimeout: Duration(lifecycle.DefaultStartTimeout),
+			StopTimeout:  Duration(lifecycle.DefaultStopTimeout),
+		},
+	}
+}
+
+// ValidationError lists every problem found in the configuration.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// Validate checks the whole configuration and reports all problems at once.
+func (c *Config) Validate() error {
+	var problems ValidationError
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+	positive := func(name string, d Duration) {
+		check(d > 0, "%s must be positive, got %s", name, d)
+	}
+
+	if _, err := c.Log.ZapLevel(); err != nil {
+		problems = append(problems, fmt.Sprintf("log.level: %v", err))
+	}
+
+	check(len(c.Server.Address) != 0, "server.address is required")
+	check(c.Server.InternalAddress != c.Server.Address, "server.internal_address must differ from server.address")
+	positive("server.request_timeout", c.Server.RequestTimeout)
+	check(c.Server.CompressionLevel >= gzip.BestSpeed && c.Server.CompressionLevel <= gzip.BestCompression,
+		"server.compression_level must be in [%d, %d], got %d", gzip.BestSpeed, gzip.BestCompression, c.Server.CompressionLevel)
+	positive("server.readiness_timeout", c.Server.ReadinessTimeout)
+	positive("server.shutdown_timeout", c.Server.ShutdownTimeout)
+	positive("server.stream_heartbeat_interval", c.Server.StreamHeartbeatInterval)
+	check(c.Server.LoginLockout.MaxFailures >= 0,
+		"server.login_lockout.max_failures must not be negative, got %d", c.Server.LoginLockout.MaxFailures)
+	positive("server.login_lockout.duration", c.Server.LoginLockout.Duration)
+	for _, origin := range c.Server.CORSOrigins {
+		// Credentials are allowed, so a wildcard would let any site act
+		// on behalf of a logged in user.
+		if origin == "*" {
+			problems = append(problems, "server.cors_origins: \"*\" is not allowed, list the origins explicitly")
+			continue
+		}
+		if u, err := url.Parse(origin); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 || len(strings.Trim(u.Path, "/")) != 0 {
+			problems = append(problems, fmt.Sprintf("server.cors_origins: %q is not an origin such as https://example.com", origin))
+		}
+	}
+	problems = append(problems, c.Server.TLS.validate()...)
+	problems = append(problems, c.Server.RateLimit.validate()...)
+
+	check(len(c.Database.URI) != 0, "database.uri is required")
+	positive("database.operation_timeout", c.Database.OperationTimeout)
+	positive("database.export_timeout", c.Database.ExportTimeout)
+
+	if len(c.Accrual.Address) == 0 {
+		problems = append(problems, "accrual.address is required")
+	} else if u, err := url.Parse(c.Accrual.Address); err != nil || len(u.Scheme) == 0 || len(u.Host) == 0 {
+		problems = append(problems, fmt.Sprintf("accrual.address must be an absolute URL, got %q", c.Accrual.Address))
+	}
+	check(c.Accrual.PollInterval >= 0, "accrual.poll_interval must not be negative, got %s", c.Accrual.PollInterval)
+	check(c.Accrual.RetryCount >= 0, "accrual.retry_count must not be negative, got %d", c.Accrual.RetryCount)
+	positive("accrual.callback_replay_window", c.Accrual.CallbackReplayWindow)
+	positive("accrual.stuck_check_interval", c.Accrual.StuckCheckInterval)
+	positive("accrual.drain_timeout", c.Accrual.DrainTimeout)
+	check(c.Accrual.RateLimit >= 0, "accrual.rate_limit must not be negative, got %g", c.Accrual.RateLimit)
+	check(c.Accrual.RateBurst > 0, "accrual.rate_burst must be positive, got %d", c.Accrual.RateBurst)
+
+	schedule := c.Accrual.Schedule
+	positive("accrual.schedule.initial_interval", schedule.InitialInterval)
+	check(schedule.MaxInterval >= schedule.InitialInterval,
+		"accrual.schedule.max_interval must not be less than initial_interval, got %s", schedule.MaxInterval)
+	check(schedule.FastAttempts >= 0, "accrual.schedule.fast_attempts must not be negative, got %d", schedule.FastAttempts)
+	check(schedule.Multiplier >= 1, "accrual.schedule.multiplier must be at least 1, got %g", schedule.Multiplier)
+	check(schedule.Jitter >= 0 && schedule.Jitter < 1, "accrual.schedule.jitter must be in [0, 1), got %g", schedule.Jitter)
+	positive("accrual.schedule.max_age", schedule.MaxAge)
+
+	breaker := c.Accrual.Breaker
+	check(breaker.FailureThreshold > 0, "accrual.breaker.failure_threshold must be positive, got %d", breaker.FailureThreshold)
+	positive("accrual.breaker.open_timeout", breaker.OpenTimeout)
+	check(breaker.HalfOpenRequests > 0, "accrual.breaker.half_open_requests must be positive, got %d", breaker.HalfOpenRequests)
+
+	check(c.Events.HistorySize > 0, "events.history_size must be positive, got %d", c.Events.HistorySize)
+	check(c.Events.MaxSubscriptionsPerUser > 0,
+		"events.max_subscriptions_per_user must be positive, got %d", c.Events.MaxSubscriptionsPerUser)
+
+	switch c.Tracing.Exporter {
+	case tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP:
+	default:
+		problems = append(problems, fmt.Sprintf("tracing.exporter must be empty, %q or %q, got %q",
+			tracing.ExporterStdout, tracing.ExporterOTLP, c.Tracing.Exporter))
+	}
+
+	positive("lifecycle.start_timeout", c.Lifecycle.StartTimeout)
+	positive("lifecycle.stop_timeout", c.Lifecycle.StopTimeout)
+
+	if len(problems) != 0 {
+		return problems
+	}
+	return nil
+}
+
+func (c TLSConfig) Enabled() bool {
+	return len(c.CertFile) != 0
+}
+
+func (c TLSConfig) validate() []string {
+	var problems []string
+
+	if len(c.CertFile) == 0 != (len(c.KeyFile) == 0) {
+		problems = append(problems, "server.tls.cert_file and server.tls.key_file must be set together")
+	}
+	if !c.Enabled() {
+		if len(c.ClientCAFile) != 0 {
+			problems = append(problems, "server.tls.client_ca_file requires server.tls.cert_file")
+		}
+		if len(c.RedirectAddress) != 0 {
+			problems = append(problems, "server.tls.redirect_address requires server.tls.cert_file")
+		}
+	}
+
+	minVersion, err := app.ParseTLSVersion(c.MinVersion)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("server.tls.min_version: %v, got %q", err, c.MinVersion))
+	}
+	suites, err := app.ParseCipherSuites(c.CipherSuites)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("server.tls.cipher_suites: %v", err))
+	}
+	if len(c.CipherSuites) != 0 && minVersion == tls.VersionTLS13 {
+		problems = append(problems, "server.tls.cipher_suites can't be set with TLS 1.3 only, its suites are not configurable")
+	}
+	if err == nil && app.HTTP2CipherSuiteMissing(minVersion, suites) {
+		problems = append(problems, "server.tls.cipher_suites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 for HTTP/2")
+	}
+
+	if c.ReloadInterval <= 0 {
+		problems = append(problems, fmt.Sprintf("server.tls.reload_interval must be positive, got %s", c.ReloadInterval))
+	}
+	return problems
+}
+
+// Server returns the TLS settings of the API server, the config must be valid.
+func (c TLSConfig) Server() app.TLSConfig {
+	if !c.Enabled() {
+		return app.TLSConfig{}
+	}
+
+	minVersion, _ := app.ParseTLSVersion(c.MinVersion)
+	suites, _ := app.ParseCipherSuites(c.CipherSuites)
+	return app.TLSConfig{
+		CertFile:        c.CertFile,
+		KeyFile:         c.KeyFile,
+		MinVersion:      minVersion,
+		CipherSuites:    suites,
+		ClientCAFile:    c.ClientCAFile,
+		ReloadInterval:  c.ReloadInterval.Duration(),
+		RedirectAddress: c.RedirectAddress,
+	}
+}
+
+func (c RateLimitConfig) validate() []string {
+	var problems []string
+
+	switch c.Store {
+	case RateLimitStoreMemory, RateLimitStorePostgres:
+	default:
+		problems = append(problems, fmt.Sprintf("server.rate_limit.store must be %q or %q, got %q",
+			RateLimitStoreMemory, RateLimitStorePostgres, c.Store))
+	}
+	if _, err := app.ParseTrustedProxies(c.TrustedProxies); err != nil {
+		problems = append(problems, fmt.Sprintf("server.rate_limit.trusted_proxies: %v", err))
+	}
+
+	policies := []struct {
+		name   string
+		policy PolicyConfig
+	}{
+		{"login", c.Login},
+		{"user", c.User},
+		{"orders", c.Orders},
+		{"withdraw", c.Withdraw},
+	}
+	for _, p := range policies {
+		if p.policy.Rate < 0 {
+			problems = append(problems, fmt.Sprintf("server.rate_limit.%s.rate must not be negative, got %v", p.name, p.policy.Rate))
+		}
+		if p.policy.Rate > 0 && p.policy.Burst <= 0 {
+			problems = append(problems, fmt.Sprintf("server.rate_limit.%s.burst must be positive, got %d", p.name, p.policy.Burst))
+		}
+	}
+	return problems
+}
+
+// Server returns the rate limits of the API server using store, the config must be valid.
+func (c RateLimitConfig) Server(store ratelimit.Store) app.RateLimitConfig {
+	if !c.Enabled {
+		return app.RateLimitConfig{}
+	}
+
+	proxies, _ := app.ParseTrustedProxies(c.TrustedProxies)
+	return app.RateLimitConfig{
+		Store:          store,
+		TrustedProxies: proxies,
+		Login:          c.Login.Policy(),
+		User:           c.User.Policy(),
+		Orders:         c.Orders.Policy(),
+		Withdraw:       c.Withdraw.Policy(),
+	}
+}
+
+func (c LockoutConfig) Policy() app.LockoutPolicy {
+	return app.LockoutPolicy{
+		MaxFailures: c.MaxFailures,
+		Duration:    c.Duration.Duration(),
+	}
+}
+
+func (c PolicyConfig) Policy() ratelimit.Policy {
+	return ratelimit.Policy{Rate: c.Rate, Burst: c.Burst}
+}
+
+func policyConfig(p ratelimit.Policy) PolicyConfig {
+	return PolicyConfig{Rate: p.Rate, Burst: p.Burst}
+}
+
+func (c LogConfig) ZapLevel() (zapcore.Level, error) {
+	var level zapcore.Level
+	err := level.UnmarshalText([]byte(c.Level))
+	return level, err
+}
+
+// Tuning returns the reloadable settings of the accrual updater.
+func (c AccrualConfig) Tuning() accrual.Tuning {
+	return accrual.Tuning{
+		PollInterval: c.PollInterval.Duration(),
+		RateLimit:    c.RateLimit,
+		RateBurst:    c.RateBurst,
+		Schedule:     c.Schedule.Policy(),
+		Breaker:      c.Breaker.Config(),
+	}
+}
+
+// Tuning returns the reloadable settings of the API server.
+func (c ServerConfig) Tuning() app.Tuning {
+	return app.Tuning{
+		RequestTimeout: c.RequestTimeout.Duration(),
+		CORSOrigins:    c.CORSOrigins,
+		LoginLockout:   c.LoginLockout.Policy(),
+	}
+}
+
+func (c ScheduleConfig) Policy() accrual.SchedulePolicy {
+	return accrual.SchedulePolicy{
+		InitialInterval: c.InitialInterval.Duration(),
+		FastAttempts:    c.FastAttempts,
+		Multiplier:      c.Multiplier,
+		MaxInterval:     c.MaxInterval.Duration(),
+		Jitter:          c.Jitter,
+		MaxAge:          c.MaxAge.Duration(),
+	}
+}
+
+func (c BreakerConfig) Config() accrual.BreakerConfig {
+	return accrual.BreakerConfig{
+		FailureThreshold: c.FailureThreshold,
+		OpenTimeout:      c.OpenTimeout.Duration(),
+		HalfOpenRequests: c.HalfOpenRequests,
+	}
+}
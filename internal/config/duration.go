@@ -0,0 +1,34 @@
+package config
+
+import (
+	"time"
+)
+
+// Duration is a time.Duration written as "1m30s" in files, env vars and flags.
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Set makes Duration a flag.Value.
+func (d *Duration) Set(s string) error {
+	return d.UnmarshalText([]byte(s))
+}
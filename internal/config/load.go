@@ -0,0 +1,316 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	ConfigFileFlag = "config"
+	ConfigFileEnv  = "CONFIG"
+	PrintFlag      = "print-config"
+
+	maskedValue = "******"
+)
+
+var ErrUnknownFileFormat = errors.New("unknown config file format, expected .yaml, .yml or .json")
+
+// Options are the flags controlling the loading itself.
+type Options struct {
+	// File is the config file, it is optional.
+	File string
+	// PrintConfig asks to print the effective configuration and exit.
+	PrintConfig bool
+}
+
+// setting binds a config field to its flag and env var.
+type setting struct {
+	path   string
+	flag   string
+	env    string
+	value  flag.Value
+	secret bool
+}
+
+// settings lists the fields of c which can be set by flags and env vars.
+// The historical short flags and env var names are kept.
+func (c *Config) settings() []setting {
+	return []setting{
+		{path: "log.level", flag: "log-level", env: "LOG_LEVEL", value: (*stringValue)(&c.Log.Level)},
+
+		{path: "server.address", flag: "a", env: "RUN_ADDRESS", value: (*stringValue)(&c.Server.Address)},
+		{path: "server.grpc_address", flag: "g", env: "GRPC_ADDRESS", value: (*stringValue)(&c.Server.GRPCAddress)},
+		{path: "server.internal_address", flag: "internal-address", env: "INTERNAL_ADDRESS", value: (*stringValue)(&c.Server.InternalAddress)},
+		{path: "server.admin_token", flag: "admin-token", env: "ADMIN_TOKEN", value: (*stringValue)(&c.Server.AdminToken), secret: true},
+		{path: "server.validate_requests", flag: "validate-requests", env: "VALIDATE_REQUESTS", value: (*boolValue)(&c.Server.ValidateRequests)},
+		{path: "server.request_timeout", flag: "request-timeout", env: "REQUEST_TIMEOUT", value: &c.Server.RequestTimeout},
+		{path: "server.compression_level", flag: "compression-level", env: "COMPRESSION_LEVEL", value: (*intValue)(&c.Server.CompressionLevel)},
+		{path: "server.readiness_timeout", flag: "readiness-timeout", env: "READINESS_TIMEOUT", value: &c.Server.ReadinessTimeout},
+		{path: "server.shutdown_timeout", flag: "shutdown-timeout", env: "SHUTDOWN_TIMEOUT", value: &c.Server.ShutdownTimeout},
+		{path: "server.stream_heartbeat_interval", flag: "stream-heartbeat-interval", env: "STREAM_HEARTBEAT_INTERVAL", value: &c.Server.StreamHeartbeatInterval},
+		{path: "server.cors_origins", flag: "cors-origins", env: "CORS_ORIGINS", value: (*listValue)(&c.Server.CORSOrigins)},
+		{path: "server.login_lockout.max_failures", flag: "login-lockout-max-failures", env: "LOGIN_LOCKOUT_MAX_FAILURES", value: (*intValue)(&c.Server.LoginLockout.MaxFailures)},
+		{path: "server.login_lockout.duration", flag: "login-lockout-duration", env: "LOGIN_LOCKOUT_DURATION", value: &c.Server.LoginLockout.Duration},
+		{path: "server.tls.cert_file", flag: "tls-cert-file", env: "TLS_CERT_FILE", value: (*stringValue)(&c.Server.TLS.CertFile)},
+		{path: "server.tls.key_file", flag: "tls-key-file", env: "TLS_KEY_FILE", value: (*stringValue)(&c.Server.TLS.KeyFile)},
+		{path: "server.tls.min_version", flag: "tls-min-version", env: "TLS_MIN_VERSION", value: (*stringValue)(&c.Server.TLS.MinVersion)},
+		{path: "server.tls.cipher_suites", flag: "tls-cipher-suites", env: "TLS_CIPHER_SUITES", value: (*listValue)(&c.Server.TLS.CipherSuites)},
+		{path: "server.tls.client_ca_file", flag: "tls-client-ca-file", env: "TLS_CLIENT_CA_FILE", value: (*stringValue)(&c.Server.TLS.ClientCAFile)},
+		{path: "server.tls.reload_interval", flag: "tls-reload-interval", env: "TLS_RELOAD_INTERVAL", value: &c.Server.TLS.ReloadInterval},
+		{path: "server.tls.redirect_address", flag: "tls-redirect-address", env: "TLS_REDIRECT_ADDRESS", value: (*stringValue)(&c.Server.TLS.RedirectAddress)},
+		{path: "server.rate_limit.enabled", flag: "rate-limit", env: "RATE_LIMIT_ENABLED", value: (*boolValue)(&c.Server.RateLimit.Enabled)},
+		{path: "server.rate_limit.store", flag: "rate-limit-store", env: "RATE_LIMIT_STORE", value: (*stringValue)(&c.Server.RateLimit.Store)},
+		{path: "server.rate_limit.trusted_proxies", flag: "rate-limit-trusted-proxies", env: "RATE_LIMIT_TRUSTED_PROXIES", value: (*listValue)(&c.Server.RateLimit.TrustedProxies)},
+		{path: "server.rate_limit.login.rate", flag: "rate-limit-login-rate", env: "RATE_LIMIT_LOGIN_RATE", value: (*floatValue)(&c.Server.RateLimit.Login.Rate)},
+		{path: "server.rate_limit.login.burst", flag: "rate-limit-login-burst", env: "RATE_LIMIT_LOGIN_BURST", value: (*intValue)(&c.Server.RateLimit.Login.Burst)},
+		{path: "server.rate_limit.user.rate", flag: "rate-limit-user-rate", env: "RATE_LIMIT_USER_RATE", value: (*floatValue)(&c.Server.RateLimit.User.Rate)},
+		{path: "server.rate_limit.user.burst", flag: "rate-limit-user-burst", env: "RATE_LIMIT_USER_BURST", value: (*intValue)(&c.Server.RateLimit.User.Burst)},
+		{path: "server.rate_limit.orders.rate", flag: "rate-limit-orders-rate", env: "RATE_LIMIT_ORDERS_RATE", value: (*floatValue)(&c.Server.RateLimit.Orders.Rate)},
+		{path: "server.rate_limit.orders.burst", flag: "rate-limit-orders-burst", env: "RATE_LIMIT_ORDERS_BURST", value: (*intValue)(&c.Server.RateLimit.Orders.Burst)},
+		{path: "server.rate_limit.withdraw.rate", flag: "rate-limit-withdraw-rate", env: "RATE_LIMIT_WITHDRAW_RATE", value: (*floatValue)(&c.Server.RateLimit.Withdraw.Rate)},
+		{path: "server.rate_limit.withdraw.burst", flag: "rate-limit-withdraw-burst", env: "RATE_LIMIT_WITHDRAW_BURST", value: (*intValue)(&c.Server.RateLimit.Withdraw.Burst)},
+
+		{path: "database.uri", flag: "d", env: "DATABASE_URI", value: (*stringValue)(&c.Database.URI), secret: true},
+		{path: "database.operation_timeout", flag: "database-operation-timeout", env: "DATABASE_OPERATION_TIMEOUT", value: &c.Database.OperationTimeout},
+		{path: "database.export_timeout", flag: "database-export-timeout", env: "DATABASE_EXPORT_TIMEOUT", value: &c.Database.ExportTimeout},
+
+		{path: "accrual.address", flag: "r", env: "ACCRUAL_SYSTEM_ADDRESS", value: (*stringValue)(&c.Accrual.Address)},
+		{path: "accrual.poll_interval", flag: "accrual-poll-interval", env: "ACCRUAL_POLL_INTERVAL", value: &c.Accrual.PollInterval},
+		{path: "accrual.retry_count", flag: "accrual-retry-count", env: "ACCRUAL_RETRY_COUNT", value: (*intValue)(&c.Accrual.RetryCount)},
+		{path: "accrual.callback_secret", flag: "accrual-callback-secret", env: "ACCRUAL_CALLBACK_SECRET", value: (*stringValue)(&c.Accrual.CallbackSecret), secret: true},
+		{path: "accrual.callback_replay_window", flag: "accrual-callback-replay-window", env: "ACCRUAL_CALLBACK_REPLAY_WINDOW", value: &c.Accrual.CallbackReplayWindow},
+		{path: "accrual.stuck_check_interval", flag: "accrual-stuck-check-interval", env: "ACCRUAL_STUCK_CHECK_INTERVAL", value: &c.Accrual.StuckCheckInterval},
+		{path: "accrual.drain_timeout", flag: "accrual-drain-timeout", env: "ACCRUAL_DRAIN_TIMEOUT", value: &c.Accrual.DrainTimeout},
+		{path: "accrual.rate_limit", flag: "accrual-rate-limit", env: "ACCRUAL_RATE_LIMIT", value: (*floatValue)(&c.Accrual.RateLimit)},
+		{path: "accrual.rate_burst", flag: "accrual-rate-burst", env: "ACCRUAL_RATE_BURST", value: (*intValue)(&c.Accrual.RateBurst)},
+		{path: "accrual.schedule.initial_interval", flag: "accrual-poll-initial-interval", env: "ACCRUAL_POLL_INITIAL_INTERVAL", value: &c.Accrual.Schedule.InitialInterval},
+		{path: "accrual.schedule.fast_attempts", flag: "accrual-poll-fast-attempts", env: "ACCRUAL_POLL_FAST_ATTEMPTS", value: (*intValue)(&c.Accrual.Schedule.FastAttempts)},
+		{path: "accrual.schedule.multiplier", flag: "accrual-poll-multiplier", env: "ACCRUAL_POLL_MULTIPLIER", value: (*floatValue)(&c.Accrual.Schedule.Multiplier)},
+		{path: "accrual.schedule.max_interval", flag: "accrual-poll-max-interval", env: "ACCRUAL_POLL_MAX_INTERVAL", value: &c.Accrual.Schedule.MaxInterval},
+		{path: "accrual.schedule.jitter", flag: "accrual-poll-jitter", env: "ACCRUAL_POLL_JITTER", value: (*floatValue)(&c.Accrual.Schedule.Jitter)},
+		{path: "accrual.schedule.max_age", flag: "accrual-order-max-age", env: "ACCRUAL_ORDER_MAX_AGE", value: &c.Accrual.Schedule.MaxAge},
+		{path: "accrual.breaker.failure_threshold", flag: "accrual-breaker-failures", env: "ACCRUAL_BREAKER_FAILURES", value: (*intValue)(&c.Accrual.Breaker.FailureThreshold)},
+		{path: "accrual.breaker.open_timeout", flag: "accrual-breaker-open-timeout", env: "ACCRUAL_BREAKER_OPEN_TIMEOUT", value: &c.Accrual.Breaker.OpenTimeout},
+		{path: "accrual.breaker.half_open_requests", flag: "accrual-breaker-half-open-requests", env: "ACCRUAL_BREAKER_HALF_OPEN_REQUESTS", value: (*intValue)(&c.Accrual.Breaker.HalfOpenRequests)},
+
+		{path: "events.history_size", flag: "events-history-size", env: "EVENTS_HISTORY_SIZE", value: (*intValue)(&c.Events.HistorySize)},
+		{path: "events.max_subscriptions_per_user", flag: "stream-max-connections", env: "STREAM_MAX_CONNECTIONS", value: (*intValue)(&c.Events.MaxSubscriptionsPerUser)},
+
+		{path: "tracing.exporter", flag: "trace-exporter", env: "TRACE_EXPORTER", value: (*stringValue)(&c.Tracing.Exporter)},
+		{path: "tracing.otlp_endpoint", flag: "otlp-endpoint", env: "OTLP_ENDPOINT", value: (*stringValue)(&c.Tracing.OTLPEndpoint)},
+		{path: "tracing.otlp_insecure", flag: "otlp-insecure", env: "OTLP_INSECURE", value: (*boolValue)(&c.Tracing.OTLPInsecure)},
+		{path: "tracing.service_name", flag: "trace-service-name", env: "TRACE_SERVICE_NAME", value: (*stringValue)(&c.Tracing.ServiceName)},
+
+		{path: "lifecycle.start_timeout", flag: "start-timeout", env: "START_TIMEOUT", value: &c.Lifecycle.StartTimeout},
+		{path: "lifecycle.stop_timeout", flag: "stop-timeout", env: "STOP_TIMEOUT", value: &c.Lifecycle.StopTimeout},
+	}
+}
+
+// Load builds the configuration from, in increasing precedence: the
+// defaults, the config file, env vars and command line flags. Problems
+// with values of any source are reported together with the validation ones.
+// The configuration is returned along with them unless the flags can't be
+// parsed, so that it can be printed.
+func Load(name string, args []string, getenv func(string) string) (*Config, Options, error) {
+	var opts Options
+
+	// Flags are parsed first to find the config file, their values
+	// are kept raw and applied last on top of the file and env vars.
+	defaults := Default()
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&opts.File, ConfigFileFlag, getenv(ConfigFileEnv), "config file, .yaml, .yml or .json")
+	fs.BoolVar(&opts.PrintConfig, PrintFlag, false, "print the effective configuration with secrets masked and exit")
+	for _, s := range defaults.settings() {
+		_, isBool := s.value.(*boolValue)
+		fs.Var(&rawValue{value: s.value.String(), isBool: isBool}, s.flag, fmt.Sprintf("%s, env %s", s.path, s.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, opts, err
+	}
+
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	cfg := Default()
+	var problems ValidationError
+
+	if len(opts.File) != 0 {
+		if err := cfg.loadFile(opts.File); err != nil {
+			problems = append(problems, fmt.Sprintf("failed to load config file %s: %v", opts.File, err))
+		}
+	}
+
+	for _, s := range cfg.settings() {
+		if value := getenv(s.env); len(value) != 0 {
+			if err := s.value.Set(value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: bad value of %s: %v", s.path, s.env, err))
+			}
+		}
+		if value, ok := explicit[s.flag]; ok {
+			if err := s.value.Set(value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: bad value of -%s: %v", s.path, s.flag, err))
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		var verr ValidationError
+		if !errors.As(err, &verr) {
+			return &cfg, opts, err
+		}
+		problems = append(problems, verr...)
+	}
+	if len(problems) != 0 {
+		return &cfg, opts, problems
+	}
+
+	return &cfg, opts, nil
+}
+
+// loadFile overlays the values set in the file, unknown keys are errors.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(c)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		return nil
+	default:
+		return ErrUnknownFileFormat
+	}
+}
+
+// Print writes the configuration as YAML with secrets masked.
+func (c *Config) Print(w io.Writer) error {
+	masked := *c
+	for _, s := range masked.settings() {
+		if s.secret && len(s.value.String()) != 0 {
+			_ = s.value.Set(maskedValue)
+		}
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&masked); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// rawValue keeps a flag value until it is applied to the config.
+type rawValue struct {
+	value  string
+	isBool bool
+}
+
+func (v *rawValue) Set(s string) error {
+	v.value = s
+	return nil
+}
+
+func (v *rawValue) String() string {
+	return v.value
+}
+
+func (v *rawValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+type stringValue string
+
+func (v *stringValue) Set(s string) error {
+	*v = stringValue(s)
+	return nil
+}
+
+func (v *stringValue) String() string {
+	return string(*v)
+}
+
+// listValue is a comma separated list.
+type listValue []string
+
+func (v *listValue) Set(s string) error {
+	*v = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) != 0 {
+			*v = append(*v, item)
+		}
+	}
+	return nil
+}
+
+func (v *listValue) String() string {
+	return strings.Join(*v, ",")
+}
+
+type boolValue bool
+
+func (v *boolValue) Set(s string) error {
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return err
+	}
+	*v = boolValue(b)
+	return nil
+}
+
+func (v *boolValue) String() string {
+	return strconv.FormatBool(bool(*v))
+}
+
+func (v *boolValue) IsBoolFlag() bool {
+	return true
+}
+
+type intValue int
+
+func (v *intValue) Set(s string) error {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	*v = intValue(i)
+	return nil
+}
+
+func (v *intValue) String() string {
+	return strconv.Itoa(int(*v))
+}
+
+type floatValue float64
+
+func (v *floatValue) Set(s string) error {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	*v = floatValue(f)
+	return nil
+}
+
+func (v *floatValue) String() string {
+	return strconv.FormatFloat(float64(*v), 'g', -1, 64)
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"sync/atomic"
+)
+
+// reloadable are the settings applied on reload, the others
+// are kept as they were at start until the service restarts.
+var reloadable = map[string]bool{
+	"log.level":              true,
+	"server.request_timeout": true,
+
+	"server.cors_origins":               true,
+	"server.login_lockout.max_failures": true,
+	"server.login_lockout.duration":     true,
+
+	"accrual.poll_interval":              true,
+	"accrual.rate_limit":                 true,
+	"accrual.rate_burst":                 true,
+	"accrual.schedule.initial_interval":  true,
+	"accrual.schedule.fast_attempts":     true,
+	"accrual.schedule.multiplier":        true,
+	"accrual.schedule.max_interval":      true,
+	"accrual.schedule.jitter":            true,
+	"accrual.schedule.max_age":           true,
+	"accrual.breaker.failure_threshold":  true,
+	"accrual.breaker.open_timeout":       true,
+	"accrual.breaker.half_open_requests": true,
+}
+
+// Change is a setting whose value differs between two configurations.
+// Values of secrets are masked.
+type Change struct {
+	Path string
+	Old  string
+	New  string
+}
+
+// Diff lists the settings which differ between old and new.
+func Diff(old, new *Config) []Change {
+	var changes []Change
+
+	newSettings := new.settings()
+	for i, s := range old.settings() {
+		oldValue, newValue := s.value.String(), newSettings[i].value.String()
+		if oldValue == newValue {
+			continue
+		}
+
+		if s.secret {
+			oldValue, newValue = mask(oldValue), mask(newValue)
+		}
+		changes = append(changes, Change{Path: s.path, Old: oldValue, New: newValue})
+	}
+	return changes
+}
+
+func mask(value string) string {
+	if len(value) == 0 {
+		return value
+	}
+	return maskedValue
+}
+
+// Snapshot holds the current configuration. Readers get an immutable
+// *Config, Reload swaps it atomically.
+type Snapshot struct {
+	value atomic.Value
+}
+
+func NewSnapshot(cfg *Config) *Snapshot {
+	s := &Snapshot{}
+	s.value.Store(cfg)
+	return s
+}
+
+func (s *Snapshot) Load() *Config {
+	return s.value.Load().(*Config)
+}
+
+// Reload loads the configuration again the same way Load does and swaps
+// in the reloadable settings. It returns the applied changes and the
+// ones ignored until restart. The snapshot is unchanged on error.
+func (s *Snapshot) Reload(name string, args []string, getenv func(string) string) (applied, ignored []Change, err error) {
+	loaded, _, err := Load(name, args, getenv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	current := s.Load()
+	next := *current
+
+	nextSettings := next.settings()
+	loadedSettings := loaded.settings()
+	for _, c := range Diff(current, loaded) {
+		if !reloadable[c.Path] {
+			ignored = append(ignored, c)
+			continue
+		}
+
+		for i, setting := range nextSettings {
+			if setting.path == c.Path {
+				if err := setting.value.Set(loadedSettings[i].value.String()); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		applied = append(applied, c)
+	}
+
+	if len(applied) != 0 {
+		s.value.Store(&next)
+	}
+	return applied, ignored, nil
+}
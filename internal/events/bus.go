@@ -0,0 +1,171 @@
+package events
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	TypeOrderStatusChanged  = "order-status-changed"
+	TypeBalanceChanged      = "balance-changed"
+	TypeWithdrawalCompleted = "withdrawal-completed"
+
+	DefaultHistorySize             = 1024
+	DefaultMaxSubscriptionsPerUser = 4
+
+	subscriptionBufferSize = 64
+)
+
+var ErrTooManySubscriptions = errors.New("too many event subscriptions")
+
+type Event struct {
+	ID     uint64
+	Type   string
+	UserID int64
+	Data   interface{}
+	Time   time.Time
+}
+
+// OrderStatus is the data of TypeOrderStatusChanged events.
+type OrderStatus struct {
+	Number  string  `json:"number"`
+	Status  string  `json:"status"`
+	Accrual float64 `json:"accrual,omitempty"`
+}
+
+// Withdrawal is the data of TypeWithdrawalCompleted events.
+type Withdrawal struct {
+	Order       string    `json:"order"`
+	Sum         float64   `json:"sum"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+type Config struct {
+	// HistorySize is the number of the last events kept
+	// to let reconnected subscribers catch up.
+	HistorySize int
+	// MaxSubscriptionsPerUser limits simultaneous subscriptions of one user.
+	MaxSubscriptionsPerUser int
+}
+
+// Bus delivers events to subscriptions of the user the event belongs to.
+// Publishing never blocks: a subscription which doesn't keep up is closed,
+// its owner is expected to resubscribe from the last received event.
+type Bus struct {
+	mu            sync.Mutex
+	cfg           Config
+	lastID        uint64
+	history       []Event
+	subscriptions map[int64]map[*Subscription]struct{}
+}
+
+type Subscription struct {
+	bus    *Bus
+	userID int64
+	events chan Event
+}
+
+func NewBus(cfg Config) *Bus {
+	if cfg.HistorySize <= 0 {
+		cfg.HistorySize = DefaultHistorySize
+	}
+	if cfg.MaxSubscriptionsPerUser <= 0 {
+		cfg.MaxSubscriptionsPerUser = DefaultMaxSubscriptionsPerUser
+	}
+
+	return &Bus{
+		cfg:           cfg,
+		history:       make([]Event, 0, cfg.HistorySize),
+		subscriptions: make(map[int64]map[*Subscription]struct{}),
+	}
+}
+
+func (b *Bus) Publish(userID int64, eventType string, data interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	e := Event{
+		ID:     b.lastID,
+		Type:   eventType,
+		UserID: userID,
+		Data:   data,
+		Time:   time.Now(),
+	}
+
+	if len(b.history) == b.cfg.HistorySize {
+		copy(b.history, b.history[1:])
+		b.history = b.history[:len(b.history)-1]
+	}
+	b.history = append(b.history, e)
+
+	for s := range b.subscriptions[userID] {
+		select {
+		case s.events <- e:
+		default:
+			b.unsubscribe(s)
+		}
+	}
+}
+
+// Subscribe starts delivering events of the user. Events published after
+// lastEventID which are still kept in history are returned for replay,
+// lastEventID 0 means no replay.
+func (b *Bus) Subscribe(userID int64, lastEventID uint64) (*Subscription, []Event, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.subscriptions[userID]) >= b.cfg.MaxSubscriptionsPerUser {
+		return nil, nil, ErrTooManySubscriptions
+	}
+
+	missed := make([]Event, 0)
+	// IDs above the last published one were issued before a restart,
+	// there is nothing to replay for them.
+	if lastEventID != 0 && lastEventID <= b.lastID {
+		for _, e := range b.history {
+			if e.ID > lastEventID && e.UserID == userID {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	s := &Subscription{
+		bus:    b,
+		userID: userID,
+		events: make(chan Event, subscriptionBufferSize),
+	}
+	if b.subscriptions[userID] == nil {
+		b.subscriptions[userID] = make(map[*Subscription]struct{})
+	}
+	b.subscriptions[userID][s] = struct{}{}
+
+	return s, missed, nil
+}
+
+func (b *Bus) unsubscribe(s *Subscription) {
+	subscriptions := b.subscriptions[s.userID]
+	if _, exists := subscriptions[s]; !exists {
+		return
+	}
+
+	delete(subscriptions, s)
+	if len(subscriptions) == 0 {
+		delete(b.subscriptions, s.userID)
+	}
+	close(s.events)
+}
+
+// Events returns the channel of published events.
+// The channel is closed when the subscription falls behind or is closed.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+func (s *Subscription) Close() {
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+
+	s.bus.unsubscribe(s)
+}
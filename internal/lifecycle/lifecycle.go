@@ -0,0 +1,148 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultStartTimeout = 30 * time.Second
+	DefaultStopTimeout  = 30 * time.Second
+)
+
+var ErrComponentFailed = errors.New("component failed")
+
+// Hook is a component of the service. OnStart must return once the
+// component is running, OnStop must release everything it holds.
+// Either of them may be nil.
+type Hook struct {
+	Name    string
+	OnStart func(ctx context.Context) error
+	OnStop  func(ctx context.Context) error
+	// StopTimeout overrides the lifecycle stop timeout for the component.
+	StopTimeout time.Duration
+}
+
+// Lifecycle starts components in the order they were appended and
+// stops them in reverse order when the service is asked to terminate,
+// when a component fails or when one of them can't start.
+type Lifecycle struct {
+	logger       *zap.Logger
+	startTimeout time.Duration
+	stopTimeout  time.Duration
+	hooks        []Hook
+
+	failOnce sync.Once
+	failed   chan error
+}
+
+type Config struct {
+	// StartTimeout bounds the start of each component.
+	StartTimeout time.Duration
+	// StopTimeout bounds the stop of components without their own timeout.
+	StopTimeout time.Duration
+}
+
+func New(logger *zap.Logger, cfg Config) *Lifecycle {
+	if cfg.StartTimeout <= 0 {
+		cfg.StartTimeout = DefaultStartTimeout
+	}
+	if cfg.StopTimeout <= 0 {
+		cfg.StopTimeout = DefaultStopTimeout
+	}
+
+	return &Lifecycle{
+		logger:       logger,
+		startTimeout: cfg.StartTimeout,
+		stopTimeout:  cfg.StopTimeout,
+		failed:       make(chan error, 1),
+	}
+}
+
+func (l *Lifecycle) Append(hook Hook) {
+	l.hooks = append(l.hooks, hook)
+}
+
+// Fail reports that a running component can't go on,
+// the lifecycle stops the service and Run returns the error.
+func (l *Lifecycle) Fail(err error) {
+	l.failOnce.Do(func() {
+		l.failed <- err
+	})
+}
+
+// Run starts the components and blocks until ctx is done, SIGTERM or
+// SIGINT is received or a component fails. Then it stops the started
+// components. It returns an error if the service didn't start or failed.
+func (l *Lifecycle) Run(ctx context.Context) error {
+	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+	defer cancel()
+
+	started, err := l.start(ctx)
+	if err == nil {
+		select {
+		case <-ctx.Done():
+			l.logger.Info("Shutting down")
+		case err = <-l.failed:
+			l.logger.Error("Shutting down after a failure", zap.Error(err))
+		}
+	}
+
+	if stopErr := l.stop(started); stopErr != nil && err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+func (l *Lifecycle) start(ctx context.Context) (int, error) {
+	for i, hook := range l.hooks {
+		if hook.OnStart == nil {
+			continue
+		}
+
+		startCtx, cancel := context.WithTimeout(ctx, l.startTimeout)
+		err := hook.OnStart(startCtx)
+		cancel()
+		if err != nil {
+			l.logger.Error("Failed to start", zap.String("component", hook.Name), zap.Error(err))
+			return i, fmt.Errorf("%s: %w", hook.Name, err)
+		}
+		l.logger.Info("Started", zap.String("component", hook.Name))
+	}
+	return len(l.hooks), nil
+}
+
+// stop stops the first count components in reverse order.
+func (l *Lifecycle) stop(count int) error {
+	var result error
+	for i := count - 1; i >= 0; i-- {
+		hook := l.hooks[i]
+		if hook.OnStop == nil {
+			continue
+		}
+
+		timeout := l.stopTimeout
+		if hook.StopTimeout > 0 {
+			timeout = hook.StopTimeout
+		}
+
+		stopCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		err := hook.OnStop(stopCtx)
+		cancel()
+		if err != nil {
+			l.logger.Error("Failed to stop", zap.String("component", hook.Name), zap.Error(err))
+			if result == nil {
+				result = fmt.Errorf("%s: %w", hook.Name, err)
+			}
+			continue
+		}
+		l.logger.Info("Stopped", zap.String("component", hook.Name))
+	}
+	return result
+}
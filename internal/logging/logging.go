@@ -0,0 +1,21 @@
+package logging
+
+import (
+	"context"
+	"go.uber.org/zap"
+)
+
+type contextKey struct{}
+
+// WithLogger returns a copy of ctx carrying the request-scoped logger.
+func WithLogger(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the request-scoped logger, fallback if ctx has none.
+func FromContext(ctx context.Context, fallback *zap.Logger) *zap.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*zap.Logger); ok {
+		return logger
+	}
+	return fallback
+}
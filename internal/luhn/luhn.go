@@ -1,6 +1,7 @@
-package app
+// Package luhn checks order numbers with the Luhn algorithm.
+package luhn
 
-func IsValidLuhn(number string) bool {
+func IsValid(number string) bool {
 	digitsCount := len(number)
 	isSecond := false
 	sum := 0
@@ -0,0 +1,173 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const namespace = "gophermart"
+
+// Metrics holds the collectors of the service. They are registered in
+// a dedicated registry, so nothing is shared through the global one.
+// All methods are no-ops on a nil *Metrics.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+
+	storageDuration *prometheus.HistogramVec
+	storageErrors   *prometheus.CounterVec
+
+	accrualPolls    *prometheus.CounterVec
+	pendingOrders   prometheus.Gauge
+	creditedPoints  prometheus.Counter
+	withdrawals     prometheus.Counter
+	withdrawnPoints prometheus.Counter
+}
+
+func New() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "HTTP requests by route pattern, method and status code.",
+		}, []string{"route", "method", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "HTTP request latency by route pattern and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "operation_duration_seconds",
+			Help:      "Storage operation latency by method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "storage",
+			Name:      "errors_total",
+			Help:      "Storage operations that returned an error by method.",
+		}, []string{"method"}),
+
+		accrualPolls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "accrual",
+			Name:      "polls_total",
+			Help:      "Accrual system polls by response status code, \"error\" if there was no response.",
+		}, []string{"code"}),
+		pendingOrders: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "accrual",
+			Name:      "pending_orders",
+			Help:      "Orders due for polling in the last cycle.",
+		}),
+		creditedPoints: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "balance",
+			Name:      "credited_points_total",
+			Help:      "Points credited to user balances.",
+		}),
+		withdrawals: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "balance",
+			Name:      "withdrawals_total",
+			Help:      "Completed withdrawals.",
+		}),
+		withdrawnPoints: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "balance",
+			Name:      "withdrawn_points_total",
+			Help:      "Points withdrawn from user balances.",
+		}),
+	}
+
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpDuration,
+		m.storageDuration,
+		m.storageErrors,
+		m.accrualPolls,
+		m.pendingOrders,
+		m.creditedPoints,
+		m.withdrawals,
+		m.withdrawnPoints,
+	)
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+func (m *Metrics) ObserveHTTPRequest(route, method string, code int, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.httpRequests.WithLabelValues(route, method, strconv.Itoa(code)).Inc()
+	m.httpDuration.WithLabelValues(route, method).Observe(duration.Seconds())
+}
+
+func (m *Metrics) ObserveStorageOperation(method string, duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	m.storageDuration.WithLabelValues(method).Observe(duration.Seconds())
+	if err != nil {
+		m.storageErrors.WithLabelValues(method).Inc()
+	}
+}
+
+// AccrualPoll counts a poll of the accrual system, code is 0
+// if the request failed without a response.
+func (m *Metrics) AccrualPoll(code int) {
+	if m == nil {
+		return
+	}
+
+	label := "error"
+	if code != 0 {
+		label = strconv.Itoa(code)
+	}
+	m.accrualPolls.WithLabelValues(label).Inc()
+}
+
+func (m *Metrics) SetPendingOrders(count int) {
+	if m == nil {
+		return
+	}
+	m.pendingOrders.Set(float64(count))
+}
+
+func (m *Metrics) AddCreditedPoints(points float64) {
+	if m == nil || points <= 0 {
+		return
+	}
+	m.creditedPoints.Add(points)
+}
+
+func (m *Metrics) AddWithdrawal(sum float64) {
+	if m == nil || sum <= 0 {
+		return
+	}
+	m.withdrawals.Inc()
+	m.withdrawnPoints.Add(sum)
+}
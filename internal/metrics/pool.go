@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolCollector reads the pgx pool statistics on every scrape.
+type poolCollector struct {
+	pool *pgxpool.Pool
+
+	acquiredConns     *prometheus.Desc
+	idleConns         *prometheus.Desc
+	constructingConns *prometheus.Desc
+	totalConns        *prometheus.Desc
+	maxConns          *prometheus.Desc
+	acquires          *prometheus.Desc
+	acquireDuration   *prometheus.Desc
+	emptyAcquires     *prometheus.Desc
+	canceledAcquires  *prometheus.Desc
+}
+
+// RegisterPool exports the statistics of the database connection pool.
+func (m *Metrics) RegisterPool(pool *pgxpool.Pool) error {
+	if m == nil {
+		return nil
+	}
+
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, nil, nil)
+	}
+
+	return m.Registry.Register(&poolCollector{
+		pool: pool,
+
+		acquiredConns:     desc("acquired_connections", "Connections currently in use."),
+		idleConns:         desc("idle_connections", "Idle connections."),
+		constructingConns: desc("constructing_connections", "Connections being established."),
+		totalConns:        desc("connections", "Open connections."),
+		maxConns:          desc("max_connections", "Maximum size of the pool."),
+		acquires:          desc("acquires_total", "Successful connection acquires."),
+		acquireDuration:   desc("acquire_duration_seconds_total", "Time spent acquiring connections."),
+		emptyAcquires:     desc("empty_acquires_total", "Acquires that had to wait for a connection."),
+		canceledAcquires:  desc("canceled_acquires_total", "Acquires canceled by their context."),
+	})
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.acquiredConns
+	ch <- c.idleConns
+	ch <- c.constructingConns
+	ch <- c.totalConns
+	ch <- c.maxConns
+	ch <- c.acquires
+	ch <- c.acquireDuration
+	ch <- c.emptyAcquires
+	ch <- c.canceledAcquires
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+
+	ch <- prometheus.MustNewConstMetric(c.acquiredConns, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(c.constructingConns, prometheus.GaugeValue, float64(stat.ConstructingConns()))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(c.maxConns, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(c.acquires, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.acquireDuration, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+	ch <- prometheus.MustNewConstMetric(c.emptyAcquires, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.canceledAcquires, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+}
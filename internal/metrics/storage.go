@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"context"
+	"github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+	"time"
+)
+
+// instrumentedStorage measures every storage operation and counts
+// credited and withdrawn points of the successful ones.
+type instrumentedStorage struct {
+	st      storage.AppStorage
+	metrics *Metrics
+}
+
+// InstrumentStorage wraps st, st is returned as is if m is nil.
+func InstrumentStorage(st storage.AppStorage, m *Metrics) storage.AppStorage {
+	if m == nil {
+		return st
+	}
+	return &instrumentedStorage{st: st, metrics: m}
+}
+
+func (s *instrumentedStorage) observe(method string, start time.Time, err error) {
+	s.metrics.ObserveStorageOperation(method, time.Since(start), err)
+}
+
+func (s *instrumentedStorage) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := s.st.Ping(ctx)
+	s.observe("Ping", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) GetSchemaVersion(ctx context.Context) (int, error) {
+	start := time.Now()
+	result, err := s.st.GetSchemaVersion(ctx)
+	s.observe("GetSchemaVersion", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) AddUser(ctx context.Context, auth *storage.UserAuthorization) error {
+	start := time.Now()
+	err := s.st.AddUser(ctx, auth)
+	s.observe("AddUser", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) GetUserAuthInfo(ctx context.Context, userName string) (*storage.UserAuthorization, error) {
+	start := time.Now()
+	result, err := s.st.GetUserAuthInfo(ctx, userName)
+	s.observe("GetUserAuthInfo", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) GetUserAuthInfoByID(ctx context.Context, userID int64) (*storage.UserAuthorization, error) {
+	start := time.Now()
+	result, err := s.st.GetUserAuthInfoByID(ctx, userID)
+	s.observe("GetUserAuthInfoByID", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) Withdraw(ctx context.Context, userID, order int64, sum float64) error {
+	start := time.Now()
+	err := s.st.Withdraw(ctx, userID, order, sum)
+	s.observe("Withdraw", start, err)
+	if err == nil {
+		s.metrics.AddWithdrawal(sum)
+	}
+	return err
+}
+
+func (s *instrumentedStorage) AddBalance(ctx context.Context, userID int64, amount float64) error {
+	start := time.Now()
+	err := s.st.AddBalance(ctx, userID, amount)
+	s.observe("AddBalance", start, err)
+	if err == nil {
+		s.metrics.AddCreditedPoints(amount)
+	}
+	return err
+}
+
+func (s *instrumentedStorage) UpdateBalanceFromOrders(ctx context.Context, orders []storage.Order) ([]storage.Order, error) {
+	start := time.Now()
+	credited, err := s.st.UpdateBalanceFromOrders(ctx, orders)
+	s.observe("UpdateBalanceFromOrders", start, err)
+	for _, o := range credited {
+		s.metrics.AddCreditedPoints(o.Accrual)
+	}
+	return credited, err
+}
+
+func (s *instrumentedStorage) GetBalance(ctx context.Context, userID int64) (*storage.BalanceInfo, error) {
+	start := time.Now()
+	result, err := s.st.GetBalance(ctx, userID)
+	s.observe("GetBalance", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) GetWithdrawals(ctx context.Context, userID int64) ([]storage.Withdrawal, error) {
+	start := time.Now()
+	result, err := s.st.GetWithdrawals(ctx, userID)
+	s.observe("GetWithdrawals", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) GetWithdrawal(ctx context.Context, userID, order int64) (*storage.Withdrawal, error) {
+	start := time.Now()
+	result, err := s.st.GetWithdrawal(ctx, userID, order)
+	s.observe("GetWithdrawal", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) ExportHistory(ctx context.Context, userID int64, filter storage.HistoryFilter, fn func(storage.HistoryEntry) error) error {
+	start := time.Now()
+	err := s.st.ExportHistory(ctx, userID, filter, fn)
+	s.observe("ExportHistory", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) AddOrder(ctx context.Context, userID, orderID int64) error {
+	start := time.Now()
+	err := s.st.AddOrder(ctx, userID, orderID)
+	s.observe("AddOrder", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) AddOrders(ctx context.Context, userID int64, orderIDs []int64) ([]storage.OrderAddResult, error) {
+	start := time.Now()
+	result, err := s.st.AddOrders(ctx, userID, orderIDs)
+	s.observe("AddOrders", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) UpdateOrder(ctx context.Context, order storage.Order) error {
+	start := time.Now()
+	err := s.st.UpdateOrder(ctx, order)
+	s.observe("UpdateOrder", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) GetOrder(ctx context.Context, orderID int64) (*storage.Order, error) {
+	start := time.Now()
+	result, err := s.st.GetOrder(ctx, orderID)
+	s.observe("GetOrder", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) GetOrders(ctx context.Context, userID int64) ([]storage.Order, error) {
+	start := time.Now()
+	result, err := s.st.GetOrders(ctx, userID)
+	s.observe("GetOrders", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) GetUnfinishedOrders(ctx context.Context) ([]storage.Order, error) {
+	start := time.Now()
+	result, err := s.st.GetUnfinishedOrders(ctx)
+	s.observe("GetUnfinishedOrders", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) ScheduleOrders(ctx context.Context, schedules []storage.OrderSchedule) error {
+	start := time.Now()
+	err := s.st.ScheduleOrders(ctx, schedules)
+	s.observe("ScheduleOrders", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) MarkStuckOrders(ctx context.Context, maxAge time.Duration) ([]storage.Order, error) {
+	start := time.Now()
+	result, err := s.st.MarkStuckOrders(ctx, maxAge)
+	s.observe("MarkStuckOrders", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) GetStuckOrders(ctx context.Context) ([]storage.Order, error) {
+	start := time.Now()
+	result, err := s.st.GetStuckOrders(ctx)
+	s.observe("GetStuckOrders", start, err)
+	return result, err
+}
+
+func (s *instrumentedStorage) RepollOrder(ctx context.Context, orderID int64) error {
+	start := time.Now()
+	err := s.st.RepollOrder(ctx, orderID)
+	s.observe("RepollOrder", start, err)
+	return err
+}
+
+func (s *instrumentedStorage) ResolveOrder(ctx context.Context, resolution storage.OrderResolution) (*storage.Order, error) {
+	start := time.Now()
+	order, err := s.st.ResolveOrder(ctx, resolution)
+	s.observe("ResolveOrder", start, err)
+	if err == nil && resolution.Action == storage.OrderActionCredit {
+		s.metrics.AddCreditedPoints(resolution.Accrual)
+	}
+	return order, err
+}
@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often full buckets are dropped, they are
+// indistinguishable from missing ones.
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket is refilled completely.
+	full time.Time
+}
+
+// MemoryStore keeps the buckets in the process memory, every instance
+// of the service limits requests on its own.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *MemoryStore) Take(_ context.Context, key string, p Policy) (Result, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) >= sweepInterval {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(p.Burst), last: now}
+		s.buckets[key] = b
+	}
+
+	tokens, result := take(p, b.tokens, b.last, now)
+	b.tokens = tokens
+	b.last = now
+	b.full = now.Add(result.Reset)
+	return result, nil
+}
+
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+	s.lastSweep = now
+}
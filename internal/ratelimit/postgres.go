@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"sync"
+	"time"
+)
+
+const (
+	// LockBucket creates a full bucket if it is missing, the no-op update
+	// locks an existing one until the transaction ends. now() is the start
+	// of the transaction, which may precede the update of a concurrent one
+	// the lock waited for, so the time is read once the lock is taken.
+	LockBucket = `
+		insert into rate_limit_buckets (key, tokens, updated_at, full_at)
+			values ($1, $2, clock_timestamp(), clock_timestamp())
+			on conflict (key) do update set key = excluded.key
+			returning tokens, updated_at, clock_timestamp();`
+
+	// UpdateBucket never moves updated_at back, or the elapsed time
+	// would be refilled twice.
+	UpdateBucket = `
+		update rate_limit_buckets set tokens = $2, updated_at = greatest(updated_at, $3), full_at = $4
+			where key = $1;`
+
+	DeleteFullBuckets = `delete from rate_limit_buckets where full_at <= now();`
+)
+
+// PostgresStore keeps the buckets in the database shared by the instances
+// of the service. Bucket times come from the database clock.
+type PostgresStore struct {
+	conn    *pgxpool.Pool
+	timeout time.Duration
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// NewPostgresStore bounds every query by timeout. The rate_limit_buckets
+// table is a part of the schema migrated by storage.NewDatabaseStorage.
+func NewPostgresStore(conn *pgxpool.Pool, timeout time.Duration) *PostgresStore {
+	return &PostgresStore{
+		conn:      conn,
+		timeout:   timeout,
+		lastSweep: time.Now(),
+	}
+}
+
+func (s *PostgresStore) Take(ctx context.Context, key string, p Policy) (Result, error) {
+	opCtx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	if err := s.sweep(opCtx); err != nil {
+		return Result{}, err
+	}
+
+	tx, err := s.conn.Begin(opCtx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		tokens    float64
+		last, now time.Time
+	)
+	if err := tx.QueryRow(opCtx, LockBucket, key, float64(p.Burst)).Scan(&tokens, &last, &now); err != nil {
+		return Result{}, err
+	}
+
+	tokens, result := take(p, tokens, last, now)
+	if _, err := tx.Exec(opCtx, UpdateBucket, key, tokens, now, now.Add(result.Reset)); err != nil {
+		return Result{}, err
+	}
+
+	return result, tx.Commit(opCtx)
+}
+
+// sweep drops full buckets once in sweepInterval.
+func (s *PostgresStore) sweep(ctx context.Context) error {
+	s.mu.Lock()
+	due := time.Since(s.lastSweep) >= sweepInterval
+	if due {
+		s.lastSweep = time.Now()
+	}
+	s.mu.Unlock()
+
+	if !due {
+		return nil
+	}
+	_, err := s.conn.Exec(ctx, DeleteFullBuckets)
+	return err
+}
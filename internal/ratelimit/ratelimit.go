@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Policy is a token bucket holding up to Burst tokens and refilled at Rate
+// tokens per second. Every request takes a token.
+type Policy struct {
+	Rate  float64
+	Burst int
+}
+
+// Enabled reports whether requests are limited by the policy.
+func (p Policy) Enabled() bool {
+	return p.Rate > 0 && p.Burst > 0
+}
+
+// Window is the time an empty bucket takes to refill.
+func (p Policy) Window() time.Duration {
+	return p.refillTime(float64(p.Burst))
+}
+
+func (p Policy) refillTime(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	return time.Duration(math.Ceil(tokens / p.Rate * float64(time.Second)))
+}
+
+// Result is the outcome of taking a token.
+type Result struct {
+	Allowed bool
+	// Limit is the bucket size.
+	Limit int
+	// Remaining is the number of whole tokens left.
+	Remaining int
+	// RetryAfter is the time until a token is available, zero if the request is allowed.
+	RetryAfter time.Duration
+	// Reset is the time until the bucket is full.
+	Reset time.Duration
+}
+
+// Store keeps the buckets. Buckets of different policies must have different keys.
+type Store interface {
+	// Take takes a token from the bucket of the key, a missing bucket is full.
+	Take(ctx context.Context, key string, p Policy) (Result, error)
+}
+
+// take refills the bucket which had tokens at last and takes a token if
+// there is one. It returns the tokens left in the bucket.
+func take(p Policy, tokens float64, last, now time.Time) (float64, Result) {
+	if elapsed := now.Sub(last); elapsed > 0 {
+		tokens += elapsed.Seconds() * p.Rate
+	}
+	if burst := float64(p.Burst); tokens > burst {
+		tokens = burst
+	}
+
+	result := Result{Limit: p.Burst}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = p.refillTime(1 - tokens)
+	}
+	result.Remaining = int(tokens)
+	result.Reset = p.refillTime(float64(p.Burst) - tokens)
+	return tokens, result
+}
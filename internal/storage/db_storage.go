@@ -27,7 +27,7 @@ const (
 	AddUserQuery = `insert into users (name, secret) values ($1, $2);`
 
 	GetUserQuery     = `select id, name, secret from users where name = $1 and flags = 'active';`
-	GetUserByIDQuery = `select name, secret from users where id = $1 and flags = 'active';`
+	GetUserByIDQuery = `select name, secret, data_version from users where id = $1 and flags = 'active';`
 
 	CreateOrderStatusEnum = `create type order_status as enum ('NEW', 'PROCESSING', 'INVALID', 'PROCESSED');`
 
@@ -47,11 +47,43 @@ const (
 
 	CheckOrdersTable = `select count(*) from orders;`
 
+	AddOrdersNextAttemptColumn = `alter table orders add column if not exists next_attempt_at timestamptz not null default now();`
+	AddOrdersAttemptsColumn    = `alter table orders add column if not exists attempts integer not null default 0;`
+	AddOrdersStuckColumn       = `alter table orders add column if not exists stuck boolean not null default false;`
+	CreateOrdersScheduleIndex  = `create index if not exists orders_next_attempt_idx on orders(next_attempt_at) where status in ('NEW', 'PROCESSING');`
+	AddOrdersLastPolledColumn  = `alter table orders add column if not exists last_polled_at timestamptz;`
+	AddOrdersLastResponse      = `alter table orders add column if not exists last_response text not null default '';`
+
 	AddOrder            = `insert into orders (number, user_id) values ($1, $2);`
-	UpdateOrder         = `update orders set status=$1, accrual=$2, updated_at=now() where number=$3;`
+	AddOrderIfNotExists = `insert into orders (number, user_id) values ($1, $2) on conflict (number) do nothing;`
+	UpdateOrder         = `update orders set status=$1, accrual=$2, updated_at=now() where number=$3 and status in ('NEW', 'PROCESSING');`
 	GetOrderUser        = `select user_id from orders where number = $1;`
+	GetOrder            = `select user_id, status, accrual, uploaded_at, updated_at from orders where number = $1;`
 	GetUserOrders       = `select number, status, accrual, uploaded_at from orders where user_id = $1;`
-	GetUnfinishedOrders = `select number, user_id, status, accrual, uploaded_at from orders where status in ('NEW', 'PROCESSING');`
+	GetUnfinishedOrders = `select number, user_id, status, accrual, uploaded_at, attempts, stuck from orders where status in ('NEW', 'PROCESSING') and next_attempt_at <= now();`
+	ScheduleOrder       = `update orders set next_attempt_at=$1, attempts=attempts+1, stuck=stuck or $2, last_polled_at=now(), last_response=$3 where number=$4;`
+	MarkStuckOrders     = `update orders set stuck=true where status in ('NEW', 'PROCESSING') and not stuck and uploaded_at < now() - $1::interval returning number, user_id, status, uploaded_at;`
+	GetStuckOrders      = `select number, user_id, status, accrual, uploaded_at, updated_at, attempts, last_polled_at, last_response from orders where stuck and status in ('NEW', 'PROCESSING') order by uploaded_at;`
+	RepollOrder         = `update orders set next_attempt_at=now() where number=$1 and status in ('NEW', 'PROCESSING');`
+	GetOrderForUpdate   = `select user_id, status from orders where number = $1 for update;`
+	ResolveOrder        = `update orders set status=$1, accrual=$2, stuck=false, updated_at=now() where number=$3;`
+
+	CreateOrderAuditTableScheme = `
+       create table if not exists order_audit (
+			id bigserial primary key,
+			number bigint not null,
+			action varchar(64) not null,
+			actor varchar(256) not null,
+			reason text not null,
+			accrual double precision not null default 0.0,
+			created_at timestamptz not null default now(),
+
+			FOREIGN KEY (number)
+      			REFERENCES orders(number)
+				ON DELETE CASCADE
+		);`
+
+	AddOrderAudit = `insert into order_audit (number, action, actor, reason, accrual) values ($1, $2, $3, $4, $5);`
 
 	CreateBalanceTableScheme = `
        create table balance (
@@ -87,6 +119,15 @@ const (
 	CheckWithdrawalTable = `select count(*) from withdrawal;`
 	GetUserWithdrawals   = `select number, sum, processed_at from withdrawal where user_id = $1;`
 	AddWithdrawal        = `insert into withdrawal (number, user_id, sum) values ($1, $2, $3);`
+	GetWithdrawal        = `select sum, processed_at from withdrawal where number = $1 and user_id = $2;`
+
+	GetUserHistory = `
+		select 'order', number, status::text, accrual, 0.0::double precision, uploaded_at from orders
+			where user_id = $1 and ($2::timestamptz is null or uploaded_at >= $2) and ($3::timestamptz is null or uploaded_at < $3)
+		union all
+		select 'withdrawal', number, '', 0.0, sum, processed_at from withdrawal
+			where user_id = $1 and ($2::timestamptz is null or processed_at >= $2) and ($3::timestamptz is null or processed_at < $3)
+		order by 6;`
 
 	CreateUserRelationsFunction = `
 		CREATE OR REPLACE FUNCTION function_create_user_relations() RETURNS TRIGGER AS
@@ -109,46 +150,189 @@ const (
 			execute procedure function_create_user_relations();
 	`
 
-	DatabaseOperationTimeout = 15 * time.Second
+	AddUsersDataVersionColumn = `alter table users add column if not exists data_version bigint not null default 0;`
+
+	CreateBumpDataVersionFunction = `
+		CREATE OR REPLACE FUNCTION function_bump_data_version() RETURNS TRIGGER AS
+			$BODY$
+			BEGIN
+				update users set data_version = data_version + 1 where id = new.user_id;
+
+				RETURN new;
+			END;
+			$BODY$
+			language plpgsql;
+	`
+
+	// Only changes visible to the user bump the version,
+	// polling bookkeeping of orders doesn't.
+	CreateOrdersInsertDataVersionTrigger = `
+		drop trigger if exists orders_insert_data_version on orders;
+		create trigger orders_insert_data_version
+			after insert on orders
+			for each row
+			execute procedure function_bump_data_version();
+	`
+
+	CreateOrdersUpdateDataVersionTrigger = `
+		drop trigger if exists orders_update_data_version on orders;
+		create trigger orders_update_data_version
+			after update on orders
+			for each row
+			when (old.status is distinct from new.status or old.accrual is distinct from new.accrual)
+			execute procedure function_bump_data_version();
+	`
+
+	CreateBalanceDataVersionTrigger = `
+		drop trigger if exists balance_data_version on balance;
+		create trigger balance_data_version
+			after update on balance
+			for each row
+			when (old.current is distinct from new.current or old.withdrawn is distinct from new.withdrawn)
+			execute procedure function_bump_data_version();
+	`
+
+	// The rate limit buckets of ratelimit.PostgresStore, added in version 2.
+	CreateRateLimitBucketsTable = `
+		create table if not exists rate_limit_buckets (
+			key        text primary key,
+			tokens     double precision not null,
+			updated_at timestamptz not null,
+			full_at    timestamptz not null
+		);`
+	CreateRateLimitBucketsFullIndex = `create index if not exists rate_limit_buckets_full_at on rate_limit_buckets (full_at);`
+
+	// The schema version is recorded after all migrations are applied.
+	// Older instances never lower it.
+	CreateSchemaVersionTable = `
+		create table if not exists schema_version (
+			id boolean primary key default true check (id),
+			version integer not null
+		);`
+
+	SetSchemaVersion = `
+		insert into schema_version (version) values ($1)
+			on conflict (id) do update set version = greatest(schema_version.version, excluded.version);`
+
+	GetSchemaVersion = `select version from schema_version;`
 
 	UniqueViolationCode = "23505"
 )
 
+const (
+	DefaultOperationTimeout = 15 * time.Second
+	// DefaultExportTimeout is longer as the history is streamed to the client.
+	DefaultExportTimeout = 5 * time.Minute
+)
+
+type Config struct {
+	// OperationTimeout bounds every query, DefaultOperationTimeout is used if it is not set.
+	OperationTimeout time.Duration
+	// ExportTimeout bounds the history export, DefaultExportTimeout is used if it is not set.
+	ExportTimeout time.Duration
+}
+
 type pgxStorage struct {
 	ctx    context.Context
 	dbConn *pgxpool.Pool
+	cfg    Config
 }
 
-func NewDatabaseStorage(ctx context.Context, connection *pgxpool.Pool) (AppStorage, error) {
+func NewDatabaseStorage(ctx context.Context, connection *pgxpool.Pool, cfg Config) (AppStorage, error) {
+	if cfg.OperationTimeout <= 0 {
+		cfg.OperationTimeout = DefaultOperationTimeout
+	}
+	if cfg.ExportTimeout <= 0 {
+		cfg.ExportTimeout = DefaultExportTimeout
+	}
+
 	if err := connection.Ping(ctx); err != nil {
 		return nil, err
 	}
 
-	if err := prepareUsersTable(ctx, connection); err != nil {
+	if err := prepareUsersTable(ctx, connection, cfg.OperationTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := prepareOrdersTable(ctx, connection, cfg.OperationTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := migrateOrdersTable(ctx, connection, cfg.OperationTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := prepareBalanceTable(ctx, connection, cfg.OperationTimeout); err != nil {
+		return nil, err
+	}
+
+	if err := prepareWithdrawalTable(ctx, connection, cfg.OperationTimeout); err != nil {
 		return nil, err
 	}
 
-	if err := prepareOrdersTable(ctx, connection); err != nil {
+	if err := migrateDataVersion(ctx, connection, cfg.OperationTimeout); err != nil {
 		return nil, err
 	}
 
-	if err := prepareBalanceTable(ctx, connection); err != nil {
+	if err := migrateRateLimitBuckets(ctx, connection, cfg.OperationTimeout); err != nil {
 		return nil, err
 	}
 
-	if err := prepareWithdrawalTable(ctx, connection); err != nil {
+	if err := recordSchemaVersion(ctx, connection, cfg.OperationTimeout); err != nil {
 		return nil, err
 	}
 
 	storage := &pgxStorage{
 		ctx:    ctx,
 		dbConn: connection,
+		cfg:    cfg,
 	}
 	return storage, nil
 }
 
-func (p *pgxStorage) AddUser(ctx context.Context, auth *UserAuthorization) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) Ping(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "Ping")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
+	defer cancel()
+
+	return p.dbConn.Ping(opCtx)
+}
+
+func (p *pgxStorage) GetSchemaVersion(ctx context.Context) (_ int, err error) {
+	ctx, span := startSpan(ctx, "GetSchemaVersion", "GetSchemaVersion")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
+	defer cancel()
+
+	r, err := p.dbConn.Query(opCtx, GetSchemaVersion)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := r.Err(); err != nil {
+		return 0, err
+	}
+
+	defer r.Close()
+
+	version := 0
+	if r.Next() {
+		if err := r.Scan(&version); err != nil {
+			return 0, err
+		}
+	}
+
+	return version, nil
+}
+
+func (p *pgxStorage) AddUser(ctx context.Context, auth *UserAuthorization) (err error) {
+	ctx, span := startSpan(ctx, "AddUser", "AddUserQuery")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
 	defer cancel()
 
 	tx, err := p.dbConn.Begin(opCtx)
@@ -171,8 +355,11 @@ func (p *pgxStorage) AddUser(ctx context.Context, auth *UserAuthorization) error
 	return tx.Commit(opCtx)
 }
 
-func (p *pgxStorage) GetUserAuthInfo(ctx context.Context, userName string) (*UserAuthorization, error) {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) GetUserAuthInfo(ctx context.Context, userName string) (_ *UserAuthorization, err error) {
+	ctx, span := startSpan(ctx, "GetUserAuthInfo", "GetUserQuery")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
 	defer cancel()
 
 	r, err := p.dbConn.Query(opCtx, GetUserQuery, userName)
@@ -199,8 +386,11 @@ func (p *pgxStorage) GetUserAuthInfo(ctx context.Context, userName string) (*Use
 	return nil, ErrNoSuchUser
 }
 
-func (p *pgxStorage) GetUserAuthInfoByID(ctx context.Context, userID int64) (*UserAuthorization, error) {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) GetUserAuthInfoByID(ctx context.Context, userID int64) (_ *UserAuthorization, err error) {
+	ctx, span := startSpan(ctx, "GetUserAuthInfoByID", "GetUserByIDQuery")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
 	defer cancel()
 
 	r, err := p.dbConn.Query(opCtx, GetUserByIDQuery, userID)
@@ -217,7 +407,7 @@ func (p *pgxStorage) GetUserAuthInfoByID(ctx context.Context, userID int64) (*Us
 
 	if r.Next() {
 		authData := UserAuthorization{ID: userID, State: UserStateActive}
-		if err := r.Scan(&authData.UserName, &authData.Secret); err != nil {
+		if err := r.Scan(&authData.UserName, &authData.Secret, &authData.DataVersion); err != nil {
 			return nil, err
 		}
 
@@ -227,8 +417,11 @@ func (p *pgxStorage) GetUserAuthInfoByID(ctx context.Context, userID int64) (*Us
 	return nil, ErrNoSuchUser
 }
 
-func (p *pgxStorage) AddOrder(ctx context.Context, userID, orderID int64) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) AddOrder(ctx context.Context, userID, orderID int64) (err error) {
+	ctx, span := startSpan(ctx, "AddOrder", "AddOrder", "GetOrderUser")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
 	defer cancel()
 
 	tx, err := p.dbConn.Begin(opCtx)
@@ -270,8 +463,56 @@ func (p *pgxStorage) AddOrder(ctx context.Context, userID, orderID int64) error
 	return tx.Commit(opCtx)
 }
 
-func (p *pgxStorage) UpdateOrder(ctx context.Context, order Order) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) AddOrders(ctx context.Context, userID int64, orderIDs []int64) (_ []OrderAddResult, err error) {
+	ctx, span := startSpan(ctx, "AddOrders", "AddOrderIfNotExists", "GetOrderUser")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
+	defer cancel()
+
+	tx, err := p.dbConn.Begin(opCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(p.ctx)
+
+	results := make([]OrderAddResult, len(orderIDs))
+	for i, orderID := range orderIDs {
+		results[i].OrderID = orderID
+
+		tag, err := tx.Exec(opCtx, AddOrderIfNotExists, orderID, userID)
+		if err != nil {
+			return nil, err
+		}
+
+		if tag.RowsAffected() != 0 {
+			results[i].Result = OrderResultAccepted
+			continue
+		}
+
+		clientID := int64(0)
+		if err := tx.QueryRow(opCtx, GetOrderUser, orderID).Scan(&clientID); err != nil {
+			return nil, err
+		}
+
+		results[i].Result = OrderResultAnotherUser
+		if clientID == userID {
+			results[i].Result = OrderResultAlreadyUploaded
+		}
+	}
+
+	if err := tx.Commit(opCtx); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (p *pgxStorage) UpdateOrder(ctx context.Context, order Order) (err error) {
+	ctx, span := startSpan(ctx, "UpdateOrder", "UpdateOrder")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
 	defer cancel()
 
 	tx, err := p.dbConn.Begin(opCtx)
@@ -288,8 +529,42 @@ func (p *pgxStorage) UpdateOrder(ctx context.Context, order Order) error {
 	return tx.Commit(opCtx)
 }
 
-func (p *pgxStorage) GetOrders(ctx context.Context, userID int64) ([]Order, error) {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) GetOrder(ctx context.Context, orderID int64) (_ *Order, err error) {
+	ctx, span := startSpan(ctx, "GetOrder", "GetOrder")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
+	defer cancel()
+
+	r, err := p.dbConn.Query(opCtx, GetOrder, orderID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	if r.Next() {
+		order := Order{ID: orderID}
+		if err := r.Scan(&order.UserID, &order.Status, &order.Accrual, &order.UploadedAt, &order.UpdatedAt); err != nil {
+			return nil, err
+		}
+
+		return &order, nil
+	}
+
+	return nil, ErrNoSuchOrder
+}
+
+func (p *pgxStorage) GetOrders(ctx context.Context, userID int64) (_ []Order, err error) {
+	ctx, span := startSpan(ctx, "GetOrders", "GetUserOrders")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
 	defer cancel()
 
 	r, err := p.dbConn.Query(opCtx, GetUserOrders, userID)
@@ -318,8 +593,11 @@ func (p *pgxStorage) GetOrders(ctx context.Context, userID int64) ([]Order, erro
 	return orders, nil
 }
 
-func (p *pgxStorage) GetUnfinishedOrders(ctx context.Context) ([]Order, error) {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) GetUnfinishedOrders(ctx context.Context) (_ []Order, err error) {
+	ctx, span := startSpan(ctx, "GetUnfinishedOrders", "GetUnfinishedOrders")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
 	defer cancel()
 
 	r, err := p.dbConn.Query(opCtx, GetUnfinishedOrders)
@@ -337,17 +615,202 @@ func (p *pgxStorage) GetUnfinishedOrders(ctx context.Context) ([]Order, error) {
 	orders := make([]Order, 0)
 	for r.Next() {
 		order := Order{}
-		if err := r.Scan(&order.ID, &order.UserID, &order.Status, &order.Accrual, &order.UploadedAt); err != nil {
+		if err := r.Scan(&order.ID, &order.UserID, &order.Status, &order.Accrual, &order.UploadedAt, &order.Attempts, &order.Stuck); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, nil
+}
+
+func (p *pgxStorage) ScheduleOrders(ctx context.Context, schedules []OrderSchedule) (err error) {
+	ctx, span := startSpan(ctx, "ScheduleOrders", "ScheduleOrder")
+	defer func() { endSpan(span, err) }()
+
+	if len(schedules) == 0 {
+		return nil
+	}
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
+	defer cancel()
+
+	tx, err := p.dbConn.Begin(opCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(p.ctx)
+
+	for _, s := range schedules {
+		_, err = tx.Exec(opCtx, ScheduleOrder, s.NextAttemptAt, s.Stuck, s.LastResponse, s.OrderID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(opCtx)
+}
+
+func (p *pgxStorage) MarkStuckOrders(ctx context.Context, maxAge time.Duration) (_ []Order, err error) {
+	ctx, span := startSpan(ctx, "MarkStuckOrders", "MarkStuckOrders")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
+	defer cancel()
+
+	r, err := p.dbConn.Query(opCtx, MarkStuckOrders, maxAge)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	orders := make([]Order, 0)
+	for r.Next() {
+		order := Order{Stuck: true}
+		if err := r.Scan(&order.ID, &order.UserID, &order.Status, &order.UploadedAt); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+
+	return orders, nil
+}
+
+func (p *pgxStorage) GetStuckOrders(ctx context.Context) (_ []Order, err error) {
+	ctx, span := startSpan(ctx, "GetStuckOrders", "GetStuckOrders")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
+	defer cancel()
+
+	r, err := p.dbConn.Query(opCtx, GetStuckOrders)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	orders := make([]Order, 0)
+	for r.Next() {
+		order := Order{Stuck: true}
+		var lastPolledAt *time.Time
+		if err := r.Scan(&order.ID, &order.UserID, &order.Status, &order.Accrual, &order.UploadedAt,
+			&order.UpdatedAt, &order.Attempts, &lastPolledAt, &order.LastResponse); err != nil {
 			return nil, err
 		}
+		if lastPolledAt != nil {
+			order.LastPolledAt = *lastPolledAt
+		}
 		orders = append(orders, order)
 	}
 
 	return orders, nil
 }
 
-func (p *pgxStorage) Withdraw(ctx context.Context, userID, order int64, sum float64) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) RepollOrder(ctx context.Context, orderID int64) (err error) {
+	ctx, span := startSpan(ctx, "RepollOrder", "RepollOrder")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
+	defer cancel()
+
+	tag, err := p.dbConn.Exec(opCtx, RepollOrder, orderID)
+	if err != nil {
+		return err
+	}
+
+	if tag.RowsAffected() == 0 {
+		if _, err := p.GetOrder(ctx, orderID); err != nil {
+			return err
+		}
+		return ErrOrderFinalized
+	}
+
+	return nil
+}
+
+func (p *pgxStorage) ResolveOrder(ctx context.Context, resolution OrderResolution) (_ *Order, err error) {
+	ctx, span := startSpan(ctx, "ResolveOrder", "GetOrderForUpdate", "ResolveOrder", "AddBalance", "AddOrderAudit")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
+	defer cancel()
+
+	tx, err := p.dbConn.Begin(opCtx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(p.ctx)
+
+	r, err := tx.Query(opCtx, GetOrderForUpdate, resolution.OrderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	if !r.Next() {
+		return nil, ErrNoSuchOrder
+	}
+
+	order := Order{ID: resolution.OrderID}
+	if err := r.Scan(&order.UserID, &order.Status); err != nil {
+		return nil, err
+	}
+
+	r.Close()
+
+	if order.Status == StatusProcessed || order.Status == StatusInvalid {
+		return nil, ErrOrderFinalized
+	}
+
+	_, err = tx.Exec(opCtx, ResolveOrder, resolution.Status, resolution.Accrual, resolution.OrderID)
+	if err != nil {
+		return nil, err
+	}
+
+	if resolution.Accrual > 0 {
+		_, err = tx.Exec(opCtx, AddBalance, resolution.Accrual, order.UserID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(opCtx, AddOrderAudit, resolution.OrderID, resolution.Action,
+		resolution.Actor, resolution.Reason, resolution.Accrual)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(opCtx); err != nil {
+		return nil, err
+	}
+
+	order.Status = resolution.Status
+	order.Accrual = resolution.Accrual
+	return &order, nil
+}
+
+func (p *pgxStorage) Withdraw(ctx context.Context, userID, order int64, sum float64) (err error) {
+	ctx, span := startSpan(ctx, "Withdraw", "GetUserBalance", "SetBalance", "AddWithdrawal")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
 	defer cancel()
 
 	tx, err := p.dbConn.Begin(opCtx)
@@ -393,8 +856,11 @@ func (p *pgxStorage) Withdraw(ctx context.Context, userID, order int64, sum floa
 	return tx.Commit(opCtx)
 }
 
-func (p *pgxStorage) AddBalance(ctx context.Context, userID int64, amount float64) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) AddBalance(ctx context.Context, userID int64, amount float64) (err error) {
+	ctx, span := startSpan(ctx, "AddBalance", "AddBalance")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
 	defer cancel()
 
 	tx, err := p.dbConn.Begin(opCtx)
@@ -411,41 +877,57 @@ func (p *pgxStorage) AddBalance(ctx context.Context, userID int64, amount float6
 	return tx.Commit(opCtx)
 }
 
-func (p *pgxStorage) UpdateBalanceFromOrders(ctx context.Context, orders []Order) error {
+func (p *pgxStorage) UpdateBalanceFromOrders(ctx context.Context, orders []Order) (_ []Order, err error) {
+	ctx, span := startSpan(ctx, "UpdateBalanceFromOrders", "UpdateOrder", "AddBalance")
+	defer func() { endSpan(span, err) }()
+
 	if len(orders) == 0 {
-		return nil
+		return nil, nil
 	}
 
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
 	defer cancel()
 
 	tx, err := p.dbConn.Begin(opCtx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer tx.Rollback(p.ctx)
 
+	credited := make([]Order, 0, len(orders))
 	totalAmount := make(map[int64]float64)
 	for _, o := range orders {
-		_, err = tx.Exec(opCtx, UpdateOrder, o.Status, o.Accrual, o.ID)
+		tag, err := tx.Exec(opCtx, UpdateOrder, o.Status, o.Accrual, o.ID)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		// The order could have been finalized concurrently, e.g. by
+		// an accrual callback. Crediting it twice must be avoided.
+		if tag.RowsAffected() == 0 {
+			continue
 		}
 		totalAmount[o.UserID] += o.Accrual
+		credited = append(credited, o)
 	}
 
 	for id, amount := range totalAmount {
 		_, err = tx.Exec(opCtx, AddBalance, amount, id)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return tx.Commit(opCtx)
+	if err := tx.Commit(opCtx); err != nil {
+		return nil, err
+	}
+	return credited, nil
 }
 
-func (p *pgxStorage) GetBalance(ctx context.Context, userID int64) (*BalanceInfo, error) {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) GetBalance(ctx context.Context, userID int64) (_ *BalanceInfo, err error) {
+	ctx, span := startSpan(ctx, "GetBalance", "GetUserBalance")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
 	defer cancel()
 
 	r, err := p.dbConn.Query(opCtx, GetUserBalance, userID)
@@ -470,8 +952,11 @@ func (p *pgxStorage) GetBalance(ctx context.Context, userID int64) (*BalanceInfo
 	return &info, nil
 }
 
-func (p *pgxStorage) GetWithdrawals(ctx context.Context, userID int64) ([]Withdrawal, error) {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) GetWithdrawals(ctx context.Context, userID int64) (_ []Withdrawal, err error) {
+	ctx, span := startSpan(ctx, "GetWithdrawals", "GetUserWithdrawals")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
 	defer cancel()
 
 	r, err := p.dbConn.Query(opCtx, GetUserWithdrawals, userID)
@@ -498,8 +983,81 @@ func (p *pgxStorage) GetWithdrawals(ctx context.Context, userID int64) ([]Withdr
 	return ws, nil
 }
 
-func prepareUsersTable(ctx context.Context, conn *pgxpool.Pool) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func (p *pgxStorage) GetWithdrawal(ctx context.Context, userID, order int64) (_ *Withdrawal, err error) {
+	ctx, span := startSpan(ctx, "GetWithdrawal", "GetWithdrawal")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.OperationTimeout)
+	defer cancel()
+
+	r, err := p.dbConn.Query(opCtx, GetWithdrawal, order, userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	if r.Next() {
+		w := Withdrawal{Order: order}
+		if err := r.Scan(&w.Sum, &w.ProcessedAt); err != nil {
+			return nil, err
+		}
+
+		return &w, nil
+	}
+
+	return nil, ErrNoSuchWithdrawal
+}
+
+func (p *pgxStorage) ExportHistory(ctx context.Context, userID int64, filter HistoryFilter, fn func(HistoryEntry) error) (err error) {
+	ctx, span := startSpan(ctx, "ExportHistory", "GetUserHistory")
+	defer func() { endSpan(span, err) }()
+
+	opCtx, cancel := context.WithTimeout(ctx, p.cfg.ExportTimeout)
+	defer cancel()
+
+	var from, to interface{}
+	if !filter.From.IsZero() {
+		from = filter.From
+	}
+	if !filter.To.IsZero() {
+		to = filter.To
+	}
+
+	r, err := p.dbConn.Query(opCtx, GetUserHistory, userID, from, to)
+
+	if err != nil {
+		return err
+	}
+
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	for r.Next() {
+		e := HistoryEntry{}
+		if err := r.Scan(&e.Kind, &e.Number, &e.Status, &e.Accrual, &e.Sum, &e.Time); err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	// Unlike the other queries the rows are consumed while they arrive,
+	// so a failure in the middle has to be reported too.
+	return r.Err()
+}
+
+func prepareUsersTable(ctx context.Context, conn *pgxpool.Pool, timeout time.Duration) error {
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	_, err := conn.Exec(opCtx, CheckUsersTable)
@@ -531,8 +1089,8 @@ func prepareUsersTable(ctx context.Context, conn *pgxpool.Pool) error {
 	return tx.Commit(opCtx)
 }
 
-func prepareOrdersTable(ctx context.Context, conn *pgxpool.Pool) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func prepareOrdersTable(ctx context.Context, conn *pgxpool.Pool, timeout time.Duration) error {
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	_, err := conn.Exec(opCtx, CheckOrdersTable)
@@ -559,8 +1117,90 @@ func prepareOrdersTable(ctx context.Context, conn *pgxpool.Pool) error {
 	return tx.Commit(opCtx)
 }
 
-func prepareBalanceTable(ctx context.Context, conn *pgxpool.Pool) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func migrateOrdersTable(ctx context.Context, conn *pgxpool.Pool, timeout time.Duration) error {
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tx, err := conn.Begin(opCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	migrations := []string{
+		AddOrdersNextAttemptColumn,
+		AddOrdersAttemptsColumn,
+		AddOrdersStuckColumn,
+		CreateOrdersScheduleIndex,
+		AddOrdersLastPolledColumn,
+		AddOrdersLastResponse,
+		CreateOrderAuditTableScheme,
+	}
+	for _, m := range migrations {
+		if _, err = tx.Exec(opCtx, m); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(opCtx)
+}
+
+// migrateDataVersion sets up the per-user data version which is bumped
+// by triggers on every order and balance change.
+func migrateDataVersion(ctx context.Context, conn *pgxpool.Pool, timeout time.Duration) error {
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tx, err := conn.Begin(opCtx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	migrations := []string{
+		AddUsersDataVersionColumn,
+		CreateBumpDataVersionFunction,
+		CreateOrdersInsertDataVersionTrigger,
+		CreateOrdersUpdateDataVersionTrigger,
+		CreateBalanceDataVersionTrigger,
+	}
+	for _, m := range migrations {
+		if _, err = tx.Exec(opCtx, m); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(opCtx)
+}
+
+// migrateRateLimitBuckets creates the table shared by the rate limits of
+// the instances. It is created even if the limits are kept in memory.
+func migrateRateLimitBuckets(ctx context.Context, conn *pgxpool.Pool, timeout time.Duration) error {
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for _, m := range []string{CreateRateLimitBucketsTable, CreateRateLimitBucketsFullIndex} {
+		if _, err := conn.Exec(opCtx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func recordSchemaVersion(ctx context.Context, conn *pgxpool.Pool, timeout time.Duration) error {
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if _, err := conn.Exec(opCtx, CreateSchemaVersionTable); err != nil {
+		return err
+	}
+
+	_, err := conn.Exec(opCtx, SetSchemaVersion, SchemaVersion)
+	return err
+}
+
+func prepareBalanceTable(ctx context.Context, conn *pgxpool.Pool, timeout time.Duration) error {
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	_, err := conn.Exec(opCtx, CheckBalanceTable)
@@ -592,8 +1232,8 @@ func prepareBalanceTable(ctx context.Context, conn *pgxpool.Pool) error {
 	return tx.Commit(opCtx)
 }
 
-func prepareWithdrawalTable(ctx context.Context, conn *pgxpool.Pool) error {
-	opCtx, cancel := context.WithTimeout(ctx, DatabaseOperationTimeout)
+func prepareWithdrawalTable(ctx context.Context, conn *pgxpool.Pool, timeout time.Duration) error {
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	_, err := conn.Exec(opCtx, CheckWithdrawalTable)
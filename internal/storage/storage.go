@@ -14,6 +14,20 @@ const (
 	StatusInvalid    = "INVALID"
 	StatusProcessing = "PROCESSING"
 	StatusProcessed  = "PROCESSED"
+
+	OrderResultAccepted        = "accepted"
+	OrderResultAlreadyUploaded = "already_uploaded"
+	OrderResultAnotherUser     = "owned_by_another_user"
+
+	OrderActionInvalidate = "invalidate"
+	OrderActionCredit     = "credit"
+
+	HistoryOrder      = "order"
+	HistoryWithdrawal = "withdrawal"
+
+	// SchemaVersion is the version of the database schema this build
+	// migrates to. Bump it with every migration.
+	SchemaVersion = 2
 )
 
 var (
@@ -22,6 +36,9 @@ var (
 	ErrNotEnoughBalance   = errors.New("not enough balance")
 	ErrDuplicateOrder     = errors.New("duplicate order")
 	ErrOrderAlreadyPlaced = errors.New("order already placed")
+	ErrNoSuchOrder        = errors.New("no such order")
+	ErrOrderFinalized     = errors.New("order is already in a final state")
+	ErrNoSuchWithdrawal   = errors.New("no such withdrawal")
 )
 
 type UserAuthorization struct {
@@ -29,6 +46,8 @@ type UserAuthorization struct {
 	UserName string
 	Secret   []byte
 	State    string
+	// DataVersion changes whenever orders or balance of the user change.
+	DataVersion int64
 }
 
 type BalanceInfo struct {
@@ -48,21 +67,87 @@ type Order struct {
 	Status     string
 	Accrual    float64
 	UploadedAt time.Time
+	UpdatedAt  time.Time
+	Attempts   int
+	Stuck      bool
+
+	LastPolledAt time.Time
+	LastResponse string
+}
+
+type OrderAddResult struct {
+	OrderID int64
+	Result  string
+}
+
+type OrderSchedule struct {
+	OrderID       int64
+	NextAttemptAt time.Time
+	Stuck         bool
+	LastResponse  string
+}
+
+// OrderResolution is a manual operator decision about an unfinished order.
+// It is recorded in the order audit log together with the reason.
+type OrderResolution struct {
+	OrderID int64
+	Status  string
+	Accrual float64
+	Action  string
+	Actor   string
+	Reason  string
+}
+
+// HistoryEntry is an order or a withdrawal in the user account history.
+// Status and Accrual are set for orders, Sum is set for withdrawals.
+type HistoryEntry struct {
+	Kind    string
+	Number  int64
+	Status  string
+	Accrual float64
+	Sum     float64
+	Time    time.Time
+}
+
+// HistoryFilter limits the history to [From, To), zero bounds are open.
+type HistoryFilter struct {
+	From time.Time
+	To   time.Time
 }
 
 type AppStorage interface {
+	Ping(ctx context.Context) error
+	// GetSchemaVersion returns the recorded schema version, 0 if none is recorded.
+	GetSchemaVersion(ctx context.Context) (int, error)
+
 	AddUser(ctx context.Context, auth *UserAuthorization) error
 	GetUserAuthInfo(ctx context.Context, userName string) (*UserAuthorization, error)
 	GetUserAuthInfoByID(ctx context.Context, userID int64) (*UserAuthorization, error)
 
 	Withdraw(ctx context.Context, userID, order int64, sum float64) error
 	AddBalance(ctx context.Context, userID int64, amount float64) error
-	UpdateBalanceFromOrders(ctx context.Context, orders []Order) error
+	// UpdateBalanceFromOrders finalizes the orders and credits their accruals.
+	// It returns the orders actually credited, orders finalized concurrently
+	// are skipped.
+	UpdateBalanceFromOrders(ctx context.Context, orders []Order) ([]Order, error)
 	GetBalance(ctx context.Context, userID int64) (*BalanceInfo, error)
 	GetWithdrawals(ctx context.Context, userID int64) ([]Withdrawal, error)
+	GetWithdrawal(ctx context.Context, userID, order int64) (*Withdrawal, error)
+	// ExportHistory calls fn for every history entry in chronological
+	// order without loading the whole history into memory.
+	ExportHistory(ctx context.Context, userID int64, filter HistoryFilter, fn func(HistoryEntry) error) error
 
 	AddOrder(ctx context.Context, userID, orderID int64) error
+	AddOrders(ctx context.Context, userID int64, orderIDs []int64) ([]OrderAddResult, error)
 	UpdateOrder(ctx context.Context, order Order) error
+	GetOrder(ctx context.Context, orderID int64) (*Order, error)
 	GetOrders(ctx context.Context, userID int64) ([]Order, error)
 	GetUnfinishedOrders(ctx context.Context) ([]Order, error)
+	ScheduleOrders(ctx context.Context, schedules []OrderSchedule) error
+
+	MarkStuckOrders(ctx context.Context, maxAge time.Duration) ([]Order, error)
+	GetStuckOrders(ctx context.Context) ([]Order, error)
+	RepollOrder(ctx context.Context, orderID int64) error
+	// ResolveOrder applies the resolution and returns the resolved order.
+	ResolveOrder(ctx context.Context, resolution OrderResolution) (*Order, error)
 }
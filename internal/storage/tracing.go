@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName = "github.com/r4start/go-musthave-diploma-tpl/internal/storage"
+
+	statementNamesKey = attribute.Key("db.statement.names")
+)
+
+// startSpan starts the span of a storage method, statements are the
+// names of the SQL statements the method executes.
+func startSpan(ctx context.Context, method string, statements ...string) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, "storage."+method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBOperationKey.String(method),
+			statementNamesKey.StringSlice(statements),
+		))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,103 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"os"
+)
+
+const (
+	ExporterNone   = ""
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+
+	DefaultServiceName = "gophermart"
+)
+
+var ErrUnknownExporter = errors.New("unknown trace exporter")
+
+type Config struct {
+	// Exporter is one of ExporterNone, ExporterStdout or ExporterOTLP.
+	// Spans are not recorded with ExporterNone, the trace context
+	// of incoming requests is still propagated.
+	Exporter string
+	// OTLPEndpoint is the host:port of the collector gRPC endpoint,
+	// the OTEL_EXPORTER_OTLP_* variables are used if it is empty.
+	OTLPEndpoint string
+	OTLPInsecure bool
+
+	ServiceName string
+}
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. The returned function flushes the buffered spans.
+func Setup(ctx context.Context, cfg Config) (func(ctx context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var (
+		exporter sdktrace.SpanExporter
+		err      error
+	)
+	switch cfg.Exporter {
+	case ExporterNone:
+		return func(ctx context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		opts := make([]otlptracegrpc.Option, 0, 2)
+		if len(cfg.OTLPEndpoint) != 0 {
+			opts = append(opts, otlptracegrpc.WithEndpoint(cfg.OTLPEndpoint))
+		}
+		if cfg.OTLPInsecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	default:
+		return nil, ErrUnknownExporter
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := cfg.ServiceName
+	if len(serviceName) == 0 {
+		serviceName = DefaultServiceName
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String(serviceName),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// LogFields returns the trace and span IDs of the span in ctx,
+// so log entries can be matched with traces.
+func LogFields(ctx context.Context) []zap.Field {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return nil
+	}
+
+	return []zap.Field{
+		zap.String("trace_id", sc.TraceID().String()),
+		zap.String("span_id", sc.SpanID().String()),
+	}
+}